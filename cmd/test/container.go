@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -54,8 +56,15 @@ func namespace() {
 		logrus.Fatal(err)
 	}
 
-	go ifce.ReadLoop()
-	go ifce.WriteLoop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ifce.SetLinkDownOnExit(true)
+	go func() {
+		if err := ifce.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logrus.Error(err)
+		}
+	}()
 
 	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
 	if err != nil {
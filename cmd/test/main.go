@@ -59,6 +59,7 @@ func main() {
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	defer tun.Close()
 
 	tun.AttachToCmd(cmd)
 
@@ -67,9 +68,14 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	err = tun.Started()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	logrus.Infof("Container is at pid: %d", cmd.Process.Pid)
 
-	err = cmd.Wait()
+	err = tun.Wait(cmd)
 	if err != nil {
 		logrus.Fatal(err)
 	}
@@ -0,0 +1,10 @@
+package common
+
+// the environment variables a host.Network uses to tell the container its addresses,
+// the addresses are in CIDR notation while the gateways are plain addresses
+const (
+	EnvAddress  = "NSNET_ADDR"
+	EnvGateway  = "NSNET_GATEWAY"
+	EnvAddress6 = "NSNET_ADDR6"
+	EnvGateway6 = "NSNET_GATEWAY6"
+)
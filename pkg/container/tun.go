@@ -1,24 +1,44 @@
 package container
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
 
 	"github.com/schoentoon/nsnet/pkg/common"
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
 )
 
+// ErrHostClosed is returned by Run when the host end of the bridge went away
+var ErrHostClosed = errors.New("host closed the bridge")
+
 type TunDevice struct {
 	iface *water.Interface
 
 	bridge io.ReadWriteCloser
+
+	linkDownOnExit bool
+
+	// the single Run shared by ReadLoop and WriteLoop
+	loopOnce sync.Once
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func New(fdOffset int) (*TunDevice, error) {
+	// making it non blocking allows us to interrupt reads by closing it
+	if err := unix.SetNonblock(3+fdOffset, true); err != nil {
+		return nil, fmt.Errorf("%d is not a valid file descriptor, wrong offset? %w", 3+fdOffset, err)
+	}
+
 	bridge := os.NewFile(uintptr(3+fdOffset), "bridge")
 	if bridge == nil {
 		return nil, fmt.Errorf("%d is not a valid file descriptor, wrong offset?", 3+fdOffset)
@@ -40,25 +60,76 @@ func New(fdOffset int) (*TunDevice, error) {
 	}, nil
 }
 
+// Close is safe to call multiple times, Run closes the device as well once it returns
 func (t *TunDevice) Close() error {
-	return multierr.Combine(t.iface.Close(),
-		t.bridge.Close(),
-	)
+	t.closeOnce.Do(func() {
+		t.closeErr = multierr.Combine(t.iface.Close(),
+			t.bridge.Close(),
+		)
+	})
+	return t.closeErr
 }
 
+// SetLinkDownOnExit makes Run bring the link down when it returns, this way applications
+// see the network disappear rather than hanging on a network that no longer goes anywhere
+func (t *TunDevice) SetLinkDownOnExit(down bool) {
+	t.linkDownOnExit = down
+}
+
+// SetupNetwork assigns the address and routes to the interface. For containers attached to a host.Network
+// the addresses are taken from the environment, otherwise the container gets 10.0.0.1.
 func (t *TunDevice) SetupNetwork() error {
+	addr := &net.IPNet{
+		IP:   net.IPv4(10, 0, 0, 1),
+		Mask: net.IPv4Mask(255, 255, 255, 0),
+	}
+	gateway := net.IPv4(10, 0, 0, 1)
+
+	if env := os.Getenv(common.EnvAddress); env != "" {
+		var err error
+		addr, gateway, err = addressFromEnv(env, os.Getenv(common.EnvGateway))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := t.SetupNetworkAddress(addr, gateway); err != nil {
+		return err
+	}
+
+	if env := os.Getenv(common.EnvAddress6); env != "" {
+		addr6, gateway6, err := addressFromEnv(env, os.Getenv(common.EnvGateway6))
+		if err != nil {
+			return err
+		}
+		return t.SetupNetworkAddress(addr6, gateway6)
+	}
+
+	return nil
+}
+
+func addressFromEnv(addr, gateway string) (*net.IPNet, net.IP, error) {
+	ip, subnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return nil, nil, fmt.Errorf("invalid gateway %q", gateway)
+	}
+
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}, gw, nil
+}
+
+// SetupNetworkAddress is like SetupNetwork but with a specific address, for containers attached to a host.Network
+func (t *TunDevice) SetupNetworkAddress(addr *net.IPNet, gateway net.IP) error {
 	link, err := netlink.LinkByName(t.iface.Name())
 	if err != nil {
 		return err
 	}
 
-	addr := &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   net.IPv4(10, 0, 0, 1),
-			Mask: net.IPv4Mask(255, 255, 255, 0),
-		},
-	}
-	err = netlink.AddrAdd(link, addr)
+	err = netlink.AddrAdd(link, &netlink.Addr{IPNet: addr})
 	if err != nil {
 		return err
 	}
@@ -76,17 +147,83 @@ func (t *TunDevice) SetupNetwork() error {
 	route := &netlink.Route{
 		Scope:     netlink.SCOPE_UNIVERSE,
 		LinkIndex: link.Attrs().Index,
-		Gw:        net.IPv4(10, 0, 0, 1),
+		Gw:        gateway,
 	}
 	return netlink.RouteAdd(route)
 }
 
+// Run forwards the packets between the tun device and the bridge in both directions, until either ctx is done,
+// the host goes away (ErrHostClosed) or an error occurs. The device is closed once Run returns, and the
+// error that stopped it is returned.
+func (t *TunDevice) Run(ctx context.Context) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		buf := make([]byte, common.MTU)
+		_, err := io.CopyBuffer(t.bridge, t.iface, buf)
+		if errors.Is(err, unix.EPIPE) || errors.Is(err, unix.ECONNRESET) {
+			err = ErrHostClosed
+		}
+		errs <- err
+	}()
+
+	go func() {
+		buf := make([]byte, common.MTU)
+		_, err := io.CopyBuffer(t.iface, t.bridge, buf)
+		if err == nil {
+			err = ErrHostClosed
+		}
+		errs <- err
+	}()
+
+	var err error
+	pending := 2
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errs:
+		pending--
+	}
+
+	if t.linkDownOnExit {
+		err = multierr.Append(err, t.linkDown())
+	}
+
+	// closing the device interrupts whichever direction is still running, we don't care about its error
+	err = multierr.Append(err, t.Close())
+	for ; pending > 0; pending-- {
+		<-errs
+	}
+
+	return err
+}
+
+// ReadLoop forwards the packets from the tun device to the host.
+//
+// Deprecated: use Run, which reports why it stopped and can be cancelled. ReadLoop and WriteLoop share a single
+// Run that forwards both directions, they both return once it stops.
 func (t *TunDevice) ReadLoop() {
-	buf := make([]byte, common.MTU)
-	_, _ = io.CopyBuffer(t.bridge, t.iface, buf)
+	t.loop()
 }
 
+// WriteLoop forwards the packets from the host to the tun device.
+//
+// Deprecated: use Run, see ReadLoop.
 func (t *TunDevice) WriteLoop() {
-	buf := make([]byte, common.MTU)
-	_, _ = io.CopyBuffer(t.iface, t.bridge, buf)
+	t.loop()
+}
+
+func (t *TunDevice) loop() {
+	// Do blocks the second caller until the first one is done, so both loops return once Run does
+	t.loopOnce.Do(func() {
+		_ = t.Run(context.Background())
+	})
+}
+
+func (t *TunDevice) linkDown() error {
+	link, err := netlink.LinkByName(t.iface.Name())
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetDown(link)
 }
@@ -0,0 +1,258 @@
+package host
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// adminFlow is a flow as listed by the admin socket, the bytes are those relayed in either direction
+type adminFlow struct {
+	ID           uint64    `json:"id"`
+	Protocol     string    `json:"protocol"`
+	Container    string    `json:"container"`
+	Remote       string    `json:"remote"`
+	Start        time.Time `json:"start"`
+	LastSeen     time.Time `json:"last_seen"`
+	EgressBytes  uint64    `json:"egress_bytes"`
+	IngressBytes uint64    `json:"ingress_bytes"`
+	Egress       string    `json:"egress,omitempty"`
+}
+
+type adminPolicy struct {
+	AllowHostConnections bool        `json:"allow_host_connections"`
+	HostAliases          []HostAlias `json:"host_aliases"`
+}
+
+type adminCapture struct {
+	Running bool   `json:"running"`
+	Path    string `json:"path,omitempty"`
+}
+
+// AdminHandler returns a http.Handler that allows for inspection and control of the device.
+// It exposes the following endpoints, all of them speak JSON:
+//
+//	GET    /stats       a snapshot of the stats, see Snapshot()
+//	DELETE /stats       resets the stats
+//	GET    /flows       all the connections and UDP flows currently being forwarded
+//	DELETE /flows/{id}  kills a flow
+//	GET    /policy      the policy currently in effect
+//	GET    /capture     whether a packet capture is running
+//	POST   /capture     starts a packet capture to the pcap file at {"path": ...}
+//	DELETE /capture     stops the packet capture
+//	GET    /ratelimit   the current rate limit
+//	PUT    /ratelimit   changes the rate limit, using the same format
+//	GET    /dnat        the DNAT rules
+//	PUT    /dnat        replaces the DNAT rules, using the same format
+func (t *TunDevice) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", t.adminStats)
+	mux.HandleFunc("/flows", t.adminFlows)
+	mux.HandleFunc("/flows/", t.adminFlow)
+	mux.HandleFunc("/policy", t.adminPolicy)
+	mux.HandleFunc("/capture", t.adminCapture)
+	mux.HandleFunc("/ratelimit", t.adminRateLimit)
+	mux.HandleFunc("/dnat", t.adminDNAT)
+	return mux
+}
+
+func (t *TunDevice) serveAdmin(path string) error {
+	// the socket gives full control over the networking of the container, so it's for our own user only
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		return err
+	}
+
+	t.admin = &http.Server{Handler: t.AdminHandler()}
+	go func() {
+		if err := t.admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Admin server stopped: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err string) {
+	writeJSON(w, status, map[string]string{"error": err})
+}
+
+func (t *TunDevice) adminStats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, t.Snapshot())
+	case http.MethodDelete:
+		t.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (t *TunDevice) adminFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	out := []adminFlow{}
+	t.flows.Range(func(f *flow) bool {
+		protocol := "udp"
+		if f.proto == tcp.ProtocolNumber {
+			protocol = "tcp"
+		}
+
+		out = append(out, adminFlow{
+			ID:           f.serial,
+			Protocol:     protocol,
+			Container:    net.JoinHostPort(f.id.RemoteAddress.String(), strconv.Itoa(int(f.id.RemotePort))),
+			Remote:       net.JoinHostPort(f.id.LocalAddress.String(), strconv.Itoa(int(f.id.LocalPort))),
+			Start:        f.start,
+			LastSeen:     f.LastSeen(),
+			EgressBytes:  atomic.LoadUint64(&f.egressBytes),
+			IngressBytes: atomic.LoadUint64(&f.ingressBytes),
+			Egress:       f.via,
+		})
+		return true
+	})
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (t *TunDevice) adminFlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	serial, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/flows/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid flow id")
+		return
+	}
+
+	f := t.flows.find(serial)
+	if f == nil {
+		writeError(w, http.StatusNotFound, "flow not found")
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *TunDevice) adminPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adminPolicy{
+		AllowHostConnections: t.tcpHandler.allowHostConnections,
+		HostAliases:          t.HostAliases(),
+	})
+}
+
+func (t *TunDevice) adminCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		out := adminCapture{Running: t.capture.running()}
+		if f, ok := t.capture.current().(*os.File); ok {
+			out.Path = f.Name()
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodPost:
+		var req adminCapture
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeError(w, http.StatusBadRequest, "expected a path to write the capture to")
+			return
+		}
+
+		// the file is only truncated once we know the capture starts, it may very well be the one in use
+		var f *os.File
+		err := t.capture.startWith(func() (io.Writer, error) {
+			var err error
+			f, err = os.OpenFile(req.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			return f, err
+		})
+		if errors.Is(err, ErrCaptureRunning) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			if f != nil {
+				f.Close()
+			}
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, adminCapture{Running: true, Path: req.Path})
+	case http.MethodDelete:
+		if err := t.StopCapture(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (t *TunDevice) adminRateLimit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, t.RateLimit())
+	case http.MethodPut:
+		var req RateLimitOptions
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		t.SetRateLimit(req)
+		writeJSON(w, http.StatusOK, t.RateLimit())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (t *TunDevice) adminDNAT(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, t.DNAT())
+	case http.MethodPut:
+		var req []DNATRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := t.SetDNAT(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, t.DNAT())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,146 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func adminClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func adminRequest(t *testing.T, client *http.Client, method, path string, body interface{}, out interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://nsnet"+path, reader)
+	require.NoError(t, err)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "admin.sock")
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.AdminSocket = socket
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := adminClient(socket)
+	container := newTestContainer(t, tun)
+	listener, port := hostListener(t)
+
+	capturePath := filepath.Join(dir, "capture.pcap")
+	assert.Equal(t, http.StatusCreated, adminRequest(t, client, http.MethodPost, "/capture", adminCapture{Path: capturePath}, nil))
+
+	// a second capture is refused before its file is touched
+	otherPath := filepath.Join(dir, "other.pcap")
+	require.NoError(t, os.WriteFile(otherPath, []byte("keep"), 0600))
+	for _, path := range []string{capturePath, otherPath} {
+		assert.Equal(t, http.StatusConflict, adminRequest(t, client, http.MethodPost, "/capture", adminCapture{Path: path}, nil))
+	}
+	other, err := os.ReadFile(otherPath)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(other))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	var flows []adminFlow
+	require.Equal(t, http.StatusOK, adminRequest(t, client, http.MethodGet, "/flows", nil, &flows))
+	require.Len(t, flows, 1)
+	assert.Equal(t, "tcp", flows[0].Protocol)
+	assert.Equal(t, uint64(4), flows[0].EgressBytes)
+	assert.Equal(t, uint64(4), flows[0].IngressBytes)
+
+	var stats StatsSnapshot
+	require.Equal(t, http.StatusOK, adminRequest(t, client, http.MethodGet, "/stats", nil, &stats))
+	assert.Equal(t, uint32(1), stats.TCP.Conns)
+	assert.Equal(t, uint64(4), stats.TCP.RecvBytes)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, client, http.MethodDelete, "/stats", nil, nil))
+	assert.Equal(t, TCPStats{}, tun.Snapshot().TCP)
+
+	var policy adminPolicy
+	require.Equal(t, http.StatusOK, adminRequest(t, client, http.MethodGet, "/policy", nil, &policy))
+	assert.True(t, policy.AllowHostConnections)
+
+	var limit RateLimitOptions
+	require.Equal(t, http.StatusOK, adminRequest(t, client, http.MethodPut, "/ratelimit", RateLimitOptions{BytesPerSecond: 1024 * 1024}, &limit))
+	assert.Equal(t, RateLimitOptions{BytesPerSecond: 1024 * 1024, Burst: 1024 * 1024}, limit)
+	assert.Equal(t, limit, tun.RateLimit())
+
+	var rules []DNATRule
+	dnat := []DNATRule{{Network: "tcp", Match: "203.0.113.5:443", Target: "127.0.0.1:8443"}}
+	require.Equal(t, http.StatusOK, adminRequest(t, client, http.MethodPut, "/dnat", dnat, &rules))
+	assert.Equal(t, dnat, rules)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, client, http.MethodPut, "/dnat", []DNATRule{{Match: "203.0.113.5"}}, nil))
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, client, http.MethodDelete, fmt.Sprintf("/flows/%d", flows[0].ID), nil, nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, client, http.MethodDelete, "/flows/12345", nil, nil))
+
+	// the container should see its connection go away
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(buf)
+	assert.Error(t, err)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, client, http.MethodDelete, "/capture", nil, nil))
+
+	capture, err := os.ReadFile(capturePath)
+	require.NoError(t, err)
+	// a pcap header and at least the handshake
+	assert.Greater(t, len(capture), 24+3*(16+40))
+}
@@ -0,0 +1,254 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/schoentoon/nsnet/pkg/common"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// ErrDetached is reported by an Attachment once it was replaced by a newer one, or closed
+var ErrDetached = errors.New("detached")
+
+// Attachment is a single bridge between the device and a container process. Every process gets an attachment
+// of its own, so a restarted container doesn't require a new TunDevice. Everything that was configured on
+// the TunDevice is kept, only the flows of the previous process are reset.
+type Attachment struct {
+	tun      *TunDevice
+	endpoint *tunEndPoint
+
+	// only set for the attachments of a Network
+	name  string
+	addr  tcpip.Address
+	addr6 tcpip.Address
+	nic   tcpip.NICID
+
+	segment string
+
+	bridge      *os.File
+	containerFd *os.File
+
+	// our copy of containerFd is closed once the process started, so we notice when it is gone
+	containerOnce sync.Once
+	containerErr  error
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// loop tracks the dispatchLoop, which has to be stopped before the NIC is removed
+	loop sync.WaitGroup
+
+	lifecycle lifecycle
+}
+
+func newAttachment(t *TunDevice, endpoint *tunEndPoint) (*Attachment, error) {
+	fds, err := unix.Socketpair(unix.AF_LOCAL, unix.SOCK_STREAM|unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// only our end is non blocking, this way closing the bridge interrupts the dispatchLoop
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+		return nil, err
+	}
+
+	return &Attachment{
+		tun:         t,
+		endpoint:    endpoint,
+		bridge:      os.NewFile(uintptr(fds[0]), "bridge"),
+		containerFd: os.NewFile(uintptr(fds[1]), "bridge-container"),
+		lifecycle:   newLifecycle(),
+	}, nil
+}
+
+// NewAttachment creates a fresh bridge for a new container process, the current attachment is detached and
+// all of its flows are reset. Use AttachToCmd on the returned Attachment to hand it to the new process.
+func (t *TunDevice) NewAttachment() (*Attachment, error) {
+	if t.network != nil {
+		return nil, errNetworkAttachment
+	}
+
+	a, err := newAttachment(t, t.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	t.attachMutex.Lock()
+	// checked while holding the lock, so Shutdown is guaranteed to see our attachment
+	if err := t.Err(); err != nil {
+		t.attachMutex.Unlock()
+		_ = a.detach()
+		return nil, err
+	}
+	previous := t.attachment
+	t.attachment = a
+	if t.endpoint.dispatcher != nil {
+		a.startDispatchLoop()
+	}
+	t.attachMutex.Unlock()
+
+	if previous != nil {
+		_ = previous.detach()
+	}
+
+	// whatever the previous process had going on is gone together with it
+	t.flows.Range(func(f *flow) bool {
+		_ = f.Close()
+		return true
+	})
+
+	return a, nil
+}
+
+func (a *Attachment) startDispatchLoop() {
+	a.tun.wg.Add(1)
+	a.loop.Add(1)
+	go a.dispatchLoop()
+}
+
+// current returns the attachment packets are currently written to, this is nil for a Network
+func (t *TunDevice) current() *Attachment {
+	t.attachMutex.RLock()
+	defer t.attachMutex.RUnlock()
+	return t.attachment
+}
+
+// Current returns the attachment of the current container process, its Done and Err report when that process is
+// gone. This is nil for a Network, use Network.Attachment instead.
+func (t *TunDevice) Current() *Attachment {
+	if t.network != nil {
+		return nil
+	}
+	return t.current()
+}
+
+// attachments returns all the attachments that are currently in use
+func (t *TunDevice) attachments() []*Attachment {
+	if t.network != nil {
+		return t.network.attachments()
+	}
+	return []*Attachment{t.current()}
+}
+
+// fail stops the attachment, the device keeps running so the next container process can be attached using
+// NewAttachment
+func (a *Attachment) fail(err error) {
+	a.lifecycle.stop(err)
+}
+
+func (a *Attachment) detach() error {
+	a.lifecycle.stop(ErrDetached)
+	a.closeOnce.Do(func() {
+		a.closeErr = multierr.Combine(a.bridge.Close(), a.closeContainerFd())
+	})
+	return a.closeErr
+}
+
+func (a *Attachment) closeContainerFd() error {
+	a.containerOnce.Do(func() {
+		a.containerErr = a.containerFd.Close()
+	})
+	return a.containerErr
+}
+
+// Close detaches the attachment, if this is the current attachment the device has no container until
+// the next call to NewAttachment. For a Network this removes the attachment from the network.
+func (a *Attachment) Close() error {
+	if a.tun.network != nil {
+		return a.tun.network.remove(a)
+	}
+	return a.detach()
+}
+
+// Name returns the name the attachment was created with on a Network
+func (a *Attachment) Name() string {
+	return a.name
+}
+
+// Addr returns the address of the container on a Network
+func (a *Attachment) Addr() net.IP {
+	return net.IP(a.addr)
+}
+
+// Addr6 returns the IPv6 address of the container on a Network, this is nil if the network has no IPv6 subnet
+func (a *Attachment) Addr6() net.IP {
+	if a.addr6 == "" {
+		return nil
+	}
+	return net.IP(a.addr6)
+}
+
+// AttachToCmd adds the container end of the bridge to the ExtraFiles of cmd, this has to be called before starting it.
+// Call Started once cmd was started. For a Network the addresses of the container are added to the environment of
+// cmd as well, see container.SetupNetwork.
+func (a *Attachment) AttachToCmd(cmd *exec.Cmd) {
+	if cmd.ExtraFiles == nil {
+		cmd.ExtraFiles = []*os.File{a.containerFd}
+	} else {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, a.containerFd)
+	}
+
+	if n := a.tun.network; n != nil {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, a.environment(n)...)
+	}
+}
+
+// Started closes our copy of the container end of the bridge, call this once the cmd passed to AttachToCmd was started.
+// As long as we hold on to it the bridge stays open after the process exits, so ErrBridgeClosed would never be reported.
+func (a *Attachment) Started() error {
+	return a.closeContainerFd()
+}
+
+func (a *Attachment) environment(n *Network) []string {
+	ones, _ := n.ipam.v4.subnet.Mask.Size()
+	out := []string{
+		fmt.Sprintf("%s=%s/%d", common.EnvAddress, a.Addr(), ones),
+		fmt.Sprintf("%s=%s", common.EnvGateway, n.Gateway()),
+	}
+
+	if a.addr6 != "" {
+		ones, _ := n.ipam.v6.subnet.Mask.Size()
+		out = append(out,
+			fmt.Sprintf("%s=%s/%d", common.EnvAddress6, a.Addr6(), ones),
+			fmt.Sprintf("%s=%s", common.EnvGateway6, n.Gateway6()),
+		)
+	}
+	return out
+}
+
+// Done returns a channel that is closed once this attachment stopped, see Err for the reason
+func (a *Attachment) Done() <-chan struct{} {
+	return a.lifecycle.done
+}
+
+// Err returns nil while the attachment is in use, afterwards it returns why it stopped.
+// Next to the errors reported by TunDevice.Err this can be ErrBridgeClosed, ErrDetached or whatever fatal error
+// occurred while reading from or writing to the bridge.
+func (a *Attachment) Err() error {
+	select {
+	case <-a.lifecycle.done:
+		return a.lifecycle.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for cmd to exit, after which the attachment reports ErrContainerExited.
+// Unlike TunDevice.Wait this leaves the device running, ready for the next NewAttachment.
+func (a *Attachment) Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	a.lifecycle.stop(containerExited(err))
+	return err
+}
@@ -0,0 +1,119 @@
+package host
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAttachment(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	port := echoHostListener(t)
+	addr := net.JoinHostPort("10.0.0.100", port)
+
+	first := tun.current()
+	container := newAttachedTestContainer(t, first)
+	conn, err := container.DialTCP(t, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "first")
+
+	second, err := tun.NewAttachment()
+	require.NoError(t, err)
+	defer second.Close()
+
+	select {
+	case <-first.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("first attachment wasn't detached")
+	}
+	assert.ErrorIs(t, first.Err(), ErrDetached)
+	assert.NoError(t, second.Err())
+	assert.NoError(t, tun.Err(), "detaching shouldn't stop the device")
+
+	// the flows of the previous process are gone
+	assert.Eventually(t, func() bool {
+		empty := true
+		tun.flows.Range(func(*flow) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second*5, time.Millisecond*10)
+
+	// while the new process has working networking, using the same configuration
+	container = newAttachedTestContainer(t, second)
+	conn, err = container.DialTCP(t, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "second")
+}
+
+func TestNewAttachmentAfterClose(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	require.NoError(t, tun.Close())
+
+	_, err = tun.NewAttachment()
+	assert.ErrorIs(t, err, ErrDeviceClosed)
+}
+
+func TestNewAttachmentAfterExit(t *testing.T) {
+	path, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	first := tun.Current()
+	cmd := exec.Command(path)
+	tun.AttachToCmd(cmd)
+	require.NoError(t, cmd.Start())
+	require.NoError(t, tun.Started())
+	require.NoError(t, cmd.Wait())
+
+	waitAttachmentDone(t, first)
+	assert.ErrorIs(t, first.Err(), ErrBridgeClosed)
+
+	// the device is still there for the next process
+	second, err := tun.NewAttachment()
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, second, tun.Current())
+
+	container := newAttachedTestContainer(t, second)
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", echoHostListener(t)))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "restarted")
+}
+
+func TestNewAttachmentAfterAttachmentClose(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	first := tun.Current()
+	require.NoError(t, first.Close())
+	waitAttachmentDone(t, first)
+	assert.ErrorIs(t, first.Err(), ErrDetached)
+	assert.NoError(t, tun.Err())
+
+	second, err := tun.NewAttachment()
+	require.NoError(t, err)
+	assert.NoError(t, second.Close())
+}
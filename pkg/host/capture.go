@@ -0,0 +1,121 @@
+package host
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schoentoon/nsnet/pkg/common"
+)
+
+// https://www.tcpdump.org/linktypes.html, LINKTYPE_RAW means every packet starts with an IPv4 or IPv6 header
+const pcapLinkTypeRaw = 101
+
+var ErrCaptureRunning = errors.New("packet capture is already running")
+
+// packetCapture writes all the packets going over the bridge in the pcap format
+type packetCapture struct {
+	// enabled is checked atomically, so we don't have to grab the mutex for every packet when we're not capturing
+	enabled uint32
+
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (c *packetCapture) start(w io.Writer) error {
+	return c.startWith(func() (io.Writer, error) {
+		return w, nil
+	})
+}
+
+// startWith is start for a writer that is only opened once it is certain that no other capture is running
+func (c *packetCapture) startWith(open func() (io.Writer, error)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.w != nil {
+		return ErrCaptureRunning
+	}
+	w, err := open()
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4) // magic, microsecond resolution
+	binary.LittleEndian.PutUint16(hdr[4:], 2)          // major version
+	binary.LittleEndian.PutUint16(hdr[6:], 4)          // minor version
+	binary.LittleEndian.PutUint32(hdr[16:], common.MTU)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	c.w = w
+	atomic.StoreUint32(&c.enabled, 1)
+	return nil
+}
+
+// stop returns the writer that was in use, so the caller can close it if needed
+func (c *packetCapture) stop() io.Writer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := c.w
+	c.w = nil
+	atomic.StoreUint32(&c.enabled, 0)
+	return w
+}
+
+func (c *packetCapture) current() io.Writer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.w
+}
+
+func (c *packetCapture) running() bool {
+	return atomic.LoadUint32(&c.enabled) == 1
+}
+
+func (c *packetCapture) write(packet []byte) {
+	if !c.running() {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.w == nil {
+		return
+	}
+
+	now := time.Now()
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(packet)))
+
+	// a broken writer shouldn't break the networking, so we just stop capturing
+	if _, err := c.w.Write(append(hdr, packet...)); err != nil {
+		c.w = nil
+		atomic.StoreUint32(&c.enabled, 0)
+	}
+}
+
+// StartCapture writes every packet going to or coming from the container to w in the pcap format,
+// until StopCapture is called.
+func (t *TunDevice) StartCapture(w io.Writer) error {
+	return t.capture.start(w)
+}
+
+// StopCapture stops the packet capture, if w passed to StartCapture is an io.Closer it will be closed
+func (t *TunDevice) StopCapture() error {
+	if closer, ok := t.capture.stop().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
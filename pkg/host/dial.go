@@ -0,0 +1,85 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+)
+
+// DialContext connects to a service inside the container through the stack, without publishing it on the host.
+// Network is one of tcp, tcp4, tcp6, udp, udp4 or udp6. On a Network the host of addr can also be the name
+// of an attachment, optionally followed by .nsnet.internal.
+func (t *TunDevice) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := t.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	full, proto, err := t.resolveContainerAddr(network, addr)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return gonet.DialContextTCP(ctx, t.stack, full, proto)
+	case "udp", "udp4", "udp6":
+		return gonet.DialUDP(t.stack, nil, &full, proto)
+	}
+	return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+}
+
+// Dial is DialContext without a context
+func (t *TunDevice) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+// HTTPTransport returns a transport that sends its requests into the container, to health check a service for example
+func (t *TunDevice) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         t.DialContext,
+		MaxIdleConns:        16,
+		IdleConnTimeout:     time.Second * 30,
+		TLSHandshakeTimeout: time.Second * 10,
+	}
+}
+
+func (t *TunDevice) resolveContainerAddr(network, addr string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("invalid port %s", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && t.network != nil {
+		a := t.network.attachmentByName(strings.TrimSuffix(strings.TrimSuffix(host, "."), "."+strings.TrimSuffix(DNSZone, ".")))
+		if a != nil {
+			ip = a.Addr()
+			if strings.HasSuffix(network, "6") {
+				ip = a.Addr6()
+			}
+		}
+	}
+	if ip == nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("no such container: %s", host)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && !strings.HasSuffix(network, "6") {
+		return tcpip.FullAddress{Addr: tcpip.Address(ip4), Port: uint16(port)}, ipv4.ProtocolNumber, nil
+	} else if ip4 == nil && !strings.HasSuffix(network, "4") {
+		return tcpip.FullAddress{Addr: tcpip.Address(ip.To16()), Port: uint16(port)}, ipv6.ProtocolNumber, nil
+	}
+	return tcpip.FullAddress{}, 0, fmt.Errorf("%s is not a valid address for %s", host, network)
+}
@@ -0,0 +1,123 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestDialContext(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	echoContainerListener(t, container, 8080)
+
+	conn, err := tun.DialContext(context.Background(), "tcp", "10.0.0.1:8080")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello container")
+
+	// udp
+	pc, err := gonet.DialUDP(container.stack, &tcpip.FullAddress{NIC: nicID, Port: 5353}, nil, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err = tun.DialContext(context.Background(), "udp", "10.0.0.1:5353")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello udp")
+
+	_, err = tun.DialContext(context.Background(), "tcp6", "10.0.0.1:8080")
+	assert.Error(t, err)
+	_, err = tun.DialContext(context.Background(), "tcp", "app:8080")
+	assert.Error(t, err)
+}
+
+func TestDialContextSource(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	listener := container.ListenTCP(t, 8080)
+
+	conn, err := tun.DialContext(context.Background(), "tcp", "10.0.0.1:8080")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the connection comes from the stack itself, not from the host alias the container uses to reach the host
+	accepted, err := listener.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	source, _, err := net.SplitHostPort(accepted.RemoteAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.254", source)
+
+	opts.HostAliases = []HostAlias{{Virtual: net.IPv4(10, 0, 0, 254), Host: net.IPv4(127, 0, 0, 1)}}
+	_, err = New(opts)
+	assert.Error(t, err)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	listener := container.ListenTCP(t, 8080)
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "healthy")
+		}))
+	}()
+
+	transport := tun.HTTPTransport()
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://10.0.0.1:8080/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "healthy", string(body))
+}
+
+func TestDialContextNetwork(t *testing.T) {
+	network, err := NewNetwork(DefaultOptions())
+	require.NoError(t, err)
+	defer network.Close()
+
+	db, err := network.NewAttachment("db", nil)
+	require.NoError(t, err)
+	echoContainerListener(t, newAttachedTestContainer(t, db), 5432)
+
+	for _, addr := range []string{net.JoinHostPort(db.Addr().String(), "5432"), "db:5432", "db.nsnet.internal:5432"} {
+		conn, err := network.DialContext(context.Background(), "tcp", addr)
+		require.NoError(t, err, addr)
+		echo(t, conn, addr)
+		conn.Close()
+	}
+}
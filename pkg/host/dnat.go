@@ -0,0 +1,207 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// how long the addresses of a hostname in a DNATRule or EgressRoute are used before they're looked up again
+var resolveInterval = time.Minute
+
+// DNATRule sends the traffic of the container to a different destination than the one it asked for,
+// to point it at a test double for example. Rules are matched in order, the first match wins.
+type DNATRule struct {
+	// Network limits the rule to either tcp or udp, it applies to both when empty
+	Network string `json:"network,omitempty"`
+	// Match is either an ip or a hostname, optionally with a port. A hostname matches all of its addresses.
+	// Without a port all the ports match, ":443" matches port 443 of any address.
+	Match string `json:"match"`
+	// Target is the host:port to dial instead, a target without a port keeps the port of the original destination
+	Target string `json:"target"`
+}
+
+type dnatRule struct {
+	DNATRule
+
+	ip   tcpip.Address
+	host *resolvedHost
+	port uint16
+}
+
+// resolvedHost keeps the addresses of a hostname, they are looked up again in the background once they're stale
+type resolvedHost struct {
+	name string
+
+	// resolved holds the resolvedAddresses
+	resolved  atomic.Value
+	resolving uint32
+}
+
+type resolvedAddresses struct {
+	addrs map[tcpip.Address]struct{}
+	at    time.Time
+}
+
+func newResolvedHost(name string) *resolvedHost {
+	out := &resolvedHost{name: name}
+	out.resolve()
+	return out
+}
+
+// resolve looks up the addresses of the hostname, failures leave the previous addresses in place
+func (h *resolvedHost) resolve() {
+	ips, err := net.LookupIP(h.name)
+	if err != nil {
+		return
+	}
+
+	addrs := make(map[tcpip.Address]struct{}, len(ips))
+	for _, ip := range ips {
+		addrs[ipAddress(ip)] = struct{}{}
+	}
+	h.resolved.Store(&resolvedAddresses{addrs: addrs, at: time.Now()})
+}
+
+// contains returns whether addr is one of the addresses of the hostname
+func (h *resolvedHost) contains(addr tcpip.Address) bool {
+	resolved, _ := h.resolved.Load().(*resolvedAddresses)
+	// the lookup is done in the background, the flows are never held up by it
+	if (resolved == nil || time.Since(resolved.at) > resolveInterval) && atomic.CompareAndSwapUint32(&h.resolving, 0, 1) {
+		go func() {
+			defer atomic.StoreUint32(&h.resolving, 0)
+			h.resolve()
+		}()
+	}
+	if resolved == nil {
+		return false
+	}
+	_, ok := resolved.addrs[addr]
+	return ok
+}
+
+// dnatTable is replaced as a whole by SetDNAT, so the flows never see a partial update
+type dnatTable struct {
+	rules []*dnatRule
+}
+
+func newDNATTable(rules []DNATRule) (*dnatTable, error) {
+	out := &dnatTable{rules: make([]*dnatRule, 0, len(rules))}
+
+	for _, rule := range rules {
+		switch rule.Network {
+		case "", "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("invalid network %s in DNAT rule for %s", rule.Network, rule.Match)
+		}
+		if rule.Target == "" {
+			return nil, fmt.Errorf("DNAT rule for %s has no target", rule.Match)
+		}
+
+		r := &dnatRule{DNATRule: rule}
+		host, port, err := net.SplitHostPort(rule.Match)
+		if err != nil {
+			host, port = rule.Match, ""
+		}
+		if port != "" {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil || p == 0 {
+				return nil, fmt.Errorf("invalid port in DNAT rule for %s", rule.Match)
+			}
+			r.port = uint16(p)
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			r.ip = ipAddress(ip)
+		} else if host != "" {
+			r.host = newResolvedHost(host)
+		} else if r.port == 0 {
+			return nil, fmt.Errorf("DNAT rule for %s matches everything", rule.Match)
+		}
+
+		out.rules = append(out.rules, r)
+	}
+
+	return out, nil
+}
+
+func (r *dnatRule) matches(network string, addr tcpip.Address, port uint16) bool {
+	if r.Network != "" && r.Network != network {
+		return false
+	}
+	if r.port != 0 && r.port != port {
+		return false
+	}
+
+	switch {
+	case r.ip != "":
+		return r.ip == addr
+	case r.host != nil:
+		return r.host.contains(addr)
+	}
+	return true
+}
+
+// rewrite returns the host:port to dial instead of addr:port, if any of the rules match
+func (d *dnatTable) rewrite(network string, addr tcpip.Address, port uint16) (string, bool) {
+	for _, r := range d.rules {
+		if !r.matches(network, addr, port) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(r.Target); err == nil {
+			return r.Target, true
+		}
+		return net.JoinHostPort(r.Target, strconv.Itoa(int(port))), true
+	}
+	return "", false
+}
+
+// dnat holds the current dnatTable, which can be swapped at runtime
+type dnat struct {
+	table atomic.Value
+}
+
+func (d *dnat) current() *dnatTable {
+	table, _ := d.table.Load().(*dnatTable)
+	return table
+}
+
+// SetDNAT replaces the DNAT rules, this only applies to new connections and UDP flows
+func (t *TunDevice) SetDNAT(rules []DNATRule) error {
+	table, err := newDNATTable(rules)
+	if err != nil {
+		return err
+	}
+
+	t.dnat.table.Store(table)
+	return nil
+}
+
+// DNAT returns the DNAT rules currently in effect
+func (t *TunDevice) DNAT() []DNATRule {
+	table := t.dnat.current()
+	out := make([]DNATRule, 0, len(table.rules))
+	for _, r := range table.rules {
+		out = append(out, r.DNATRule)
+	}
+	return out
+}
+
+// upstream returns the address to dial for a flow to addr:port with the DNAT rules and host aliases applied.
+// The rewrite is what addr:port was rewritten to for tracing, it is empty if nothing was rewritten.
+func (t *TunDevice) upstream(network string, addr tcpip.Address, port uint16) (upstream string, rewrite string) {
+	if target, ok := t.dnat.current().rewrite(network, addr, port); ok {
+		return target, target
+	}
+
+	// the ports that aren't allowed are refused before we ever get here
+	host, _ := t.hostAliases.rewrite(addr, port)
+	if host != addr {
+		rewrite = host.String()
+	}
+	return net.JoinHostPort(host.String(), strconv.Itoa(int(port))), rewrite
+}
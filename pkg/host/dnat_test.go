@@ -0,0 +1,84 @@
+package host
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestDNATTable(t *testing.T) {
+	table, err := newDNATTable([]DNATRule{
+		{Network: "udp", Match: "203.0.113.5", Target: "127.0.0.1:5353"},
+		{Match: "203.0.113.5:443", Target: "127.0.0.1:8443"},
+		{Match: ":80", Target: "127.0.0.1"},
+		{Match: "localhost:25", Target: "127.0.0.1:2525"},
+	})
+	require.NoError(t, err)
+
+	addr := tcpip.Address(net.IPv4(203, 0, 113, 5).To4())
+	target, ok := table.rewrite("udp", addr, 53)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:5353", target)
+
+	target, ok = table.rewrite("tcp", addr, 443)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:8443", target)
+
+	_, ok = table.rewrite("tcp", addr, 22)
+	assert.False(t, ok)
+
+	// a target without a port keeps the original port
+	target, ok = table.rewrite("tcp", tcpip.Address(net.IPv4(198, 51, 100, 1).To4()), 80)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:80", target)
+
+	// hostnames match on their resolved addresses
+	target, ok = table.rewrite("tcp", tcpip.Address(net.IPv4(127, 0, 0, 1).To4()), 25)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:2525", target)
+
+	for _, rule := range []DNATRule{
+		{Match: "203.0.113.5"},
+		{Network: "icmp", Match: "203.0.113.5", Target: "127.0.0.1"},
+		{Match: "203.0.113.5:http", Target: "127.0.0.1"},
+		{Match: ":0", Target: "127.0.0.1"},
+	} {
+		_, err := newDNATTable([]DNATRule{rule})
+		assert.Error(t, err, rule.Match)
+	}
+}
+
+func TestDNAT(t *testing.T) {
+	tcpPort := echoHostListener(t)
+	udpPort := udpEchoHostListener(t)
+
+	opts := DefaultOptions()
+	opts.DNAT = []DNATRule{
+		{Network: "tcp", Match: "203.0.113.5:443", Target: net.JoinHostPort("127.0.0.1", tcpPort)},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	conn, err := container.DialTCP(t, "203.0.113.5:443")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello test double")
+
+	// the rules can be swapped at runtime
+	require.NoError(t, tun.SetDNAT([]DNATRule{
+		{Network: "udp", Match: "203.0.113.6:53", Target: net.JoinHostPort("127.0.0.1", udpPort)},
+	}))
+	assert.Len(t, tun.DNAT(), 1)
+	assert.Error(t, tun.SetDNAT([]DNATRule{{Match: "203.0.113.6"}}))
+
+	conn, err = container.DialUDP(t, "203.0.113.6:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello udp test double")
+}
@@ -0,0 +1,279 @@
+package host
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// DNSZone is the zone the DNS server on the gateway of a Network is authoritative for
+const DNSZone = "nsnet.internal."
+
+// the TTL of our own answers, kept short as attachments come and go
+const dnsTTL = 5
+
+// how long a DNS over TCP connection may sit idle, or wait for the upstream resolver
+var dnsTCPTimeout = time.Second * 10
+
+type DNSOptions struct {
+	// Disabled turns off the DNS server on the gateway
+	Disabled bool
+	// Upstream is where queries outside of DNSZone are forwarded to as host:port,
+	// it defaults to the first nameserver in /etc/resolv.conf
+	Upstream string
+}
+
+// dnsServer answers queries for DNSZone on the gateway, everything else is forwarded upstream
+type dnsServer struct {
+	network  *Network
+	upstream string
+
+	mutex sync.RWMutex
+	names map[string][]net.IP
+}
+
+func newDNSServer(n *Network, opts DNSOptions) *dnsServer {
+	upstream := opts.Upstream
+	if upstream == "" {
+		upstream = resolvConfNameserver("/etc/resolv.conf")
+	}
+
+	return &dnsServer{
+		network:  n,
+		upstream: upstream,
+		names:    make(map[string][]net.IP),
+	}
+}
+
+func resolvConfNameserver(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+// RegisterName makes name.nsnet.internal resolve to ips, this takes precedence over the names of the attachments
+func (n *Network) RegisterName(name string, ips ...net.IP) {
+	if n.dns == nil {
+		return
+	}
+
+	n.dns.mutex.Lock()
+	defer n.dns.mutex.Unlock()
+	n.dns.names[strings.ToLower(name)] = ips
+}
+
+// UnregisterName removes a name added using RegisterName
+func (n *Network) UnregisterName(name string) {
+	if n.dns == nil {
+		return
+	}
+
+	n.dns.mutex.Lock()
+	defer n.dns.mutex.Unlock()
+	delete(n.dns.names, strings.ToLower(name))
+}
+
+func (d *dnsServer) lookup(name string) ([]net.IP, bool) {
+	d.mutex.RLock()
+	ips, ok := d.names[name]
+	d.mutex.RUnlock()
+	if ok {
+		return ips, true
+	}
+
+	a := d.network.attachmentByName(name)
+	if a == nil {
+		// unless something else is called host, it is the alias of the host loopback if there is one
+		if name == "host" {
+			ips := d.network.hostAliases.loopback()
+			return ips, len(ips) > 0
+		}
+		return nil, false
+	}
+
+	ips = []net.IP{a.Addr()}
+	if a.addr6 != "" {
+		ips = append(ips, a.Addr6())
+	}
+	return ips, true
+}
+
+// intercepts returns whether id is a query to us
+func (d *dnsServer) intercepts(id stack.TransportEndpointID) bool {
+	if id.LocalPort != 53 {
+		return false
+	}
+	return id.LocalAddress == d.network.gateway || (d.network.gateway6 != "" && id.LocalAddress == d.network.gateway6)
+}
+
+// handle answers the query if it's for DNSZone, it returns false if the query has to be forwarded upstream instead
+func (d *dnsServer) handle(id stack.TransportEndpointID, nic tcpip.NICID, query []byte) bool {
+	response, ok := d.resolve(query)
+	if !ok {
+		return false
+	}
+	if response == nil {
+		atomic.AddUint64(&d.network.drops.Malformed, 1)
+		return true
+	}
+
+	r, tcpipErr := d.network.findUDPRoute(nic, &id)
+	if tcpipErr != nil {
+		return true
+	}
+	defer r.Release()
+
+	_, _ = writeUDP(r, &id, response)
+	return true
+}
+
+// serveTCP answers the length prefixed queries of a DNS over TCP connection until it is closed, the queries
+// outside of DNSZone are forwarded over a single connection to the upstream resolver that is dialed when needed
+func (d *dnsServer) serveTCP(conn net.Conn, dialUpstream func() (net.Conn, error)) error {
+	var upstream net.Conn
+	defer func() {
+		if upstream != nil {
+			upstream.Close()
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(dnsTCPTimeout))
+		query, err := readDNSTCP(conn)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		response, ok := d.resolve(query)
+		if !ok {
+			if upstream == nil {
+				if upstream, err = dialUpstream(); err != nil {
+					return err
+				}
+			}
+			_ = upstream.SetDeadline(time.Now().Add(dnsTCPTimeout))
+			if err := writeDNSTCP(upstream, query); err != nil {
+				return err
+			}
+			if response, err = readDNSTCP(upstream); err != nil {
+				return err
+			}
+		} else if response == nil {
+			atomic.AddUint64(&d.network.drops.Malformed, 1)
+			return nil
+		}
+
+		if err := writeDNSTCP(conn, response); err != nil {
+			return err
+		}
+	}
+}
+
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// resolve returns the response to query if it's ours to answer, a nil response means it was malformed
+func (d *dnsServer) resolve(query []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil, true
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, true
+	}
+
+	name := strings.ToLower(q.Name.String())
+	if name != DNSZone && !strings.HasSuffix(name, "."+DNSZone) {
+		return nil, false
+	}
+
+	ips, found := d.lookup(strings.TrimSuffix(name, "."+DNSZone))
+
+	rcode := dnsmessage.RCodeSuccess
+	if !found {
+		rcode = dnsmessage.RCodeNameError
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 hdr.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   hdr.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, true
+	}
+	if err := b.Question(q); err != nil {
+		return nil, true
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, true
+	}
+
+	resource := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			err = b.AResource(resource, a)
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			err = b.AAAAResource(resource, aaaa)
+		}
+		if err != nil {
+			return nil, true
+		}
+	}
+
+	out, err := b.Finish()
+	if err != nil {
+		return nil, true
+	}
+	return out, true
+}
@@ -0,0 +1,260 @@
+package host
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}))
+	out, err := b.Finish()
+	require.NoError(t, err)
+	return out
+}
+
+// resolve sends a query over conn and returns the rcode and the addresses in the answer
+func resolve(t *testing.T, conn net.Conn, name string, qtype dnsmessage.Type) (dnsmessage.RCode, []net.IP) {
+	_, err := conn.Write(dnsQuery(t, name, qtype))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(buf[:n]))
+	assert.Equal(t, uint16(42), msg.ID)
+
+	var ips []net.IP
+	for _, answer := range msg.Answers {
+		switch r := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(r.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(r.AAAA[:]))
+		}
+	}
+	return msg.RCode, ips
+}
+
+func TestDNS(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.Subnet6 = mustCIDR(t, "fd00::/64")
+	opts.Network.DNS.Upstream = "127.0.0.1:1"
+	opts.TCPOptions.AllowHostConnections = true
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	_, err = network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	network.RegisterName("cache", net.IPv4(192, 168, 1, 10))
+
+	container := newAttachedTestContainer(t, app)
+	conn, err := container.DialUDP(t, "10.0.0.1:53")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	rcode, ips := resolve(t, conn, "db.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 3).To4()}, ips)
+
+	rcode, ips = resolve(t, conn, "DB.nsnet.internal.", dnsmessage.TypeAAAA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	require.Len(t, ips, 1)
+	assert.True(t, network.Attachment("db").Addr6().Equal(ips[0]))
+
+	rcode, ips = resolve(t, conn, "host.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 100).To4()}, ips)
+
+	rcode, ips = resolve(t, conn, "cache.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(192, 168, 1, 10).To4()}, ips)
+
+	network.UnregisterName("cache")
+	rcode, ips = resolve(t, conn, "cache.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode)
+	assert.Empty(t, ips)
+}
+
+func TestDNSHost(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.DNS.Upstream = "127.0.0.1:1"
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+
+	container := newAttachedTestContainer(t, app)
+	conn, err := container.DialUDP(t, "10.0.0.1:53")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// without an alias of the host loopback there's nothing to resolve to
+	rcode, ips := resolve(t, conn, "host.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, rcode)
+	assert.Empty(t, ips)
+
+	// and an attachment called host is just that
+	_, err = network.NewAttachment("host", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	rcode, ips = resolve(t, conn, "host.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 3).To4()}, ips)
+}
+
+func TestDNSForwarding(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// a fake upstream resolver, which answers everything with 1.2.3.4
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			msg.Response = true
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+			}}
+			out, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = upstream.WriteTo(out, addr)
+		}
+	}()
+
+	opts := DefaultOptions()
+	opts.Network.DNS.Upstream = upstream.LocalAddr().String()
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+
+	container := newAttachedTestContainer(t, app)
+	conn, err := container.DialUDP(t, "10.0.0.1:53")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	rcode, ips := resolve(t, conn, "example.com.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(1, 2, 3, 4).To4()}, ips)
+}
+
+// dnsTCPConn frames the queries like DNS over TCP does, so resolve works for it as well
+type dnsTCPConn struct {
+	net.Conn
+}
+
+func (c dnsTCPConn) Write(b []byte) (int, error) {
+	return len(b), writeDNSTCP(c.Conn, b)
+}
+
+func (c dnsTCPConn) Read(b []byte) (int, error) {
+	msg, err := readDNSTCP(c.Conn)
+	return copy(b, msg), err
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+
+	// a fake upstream resolver, which answers everything with 1.2.3.4
+	var dials int32
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readDNSTCP(conn)
+					if err != nil {
+						return
+					}
+					var msg dnsmessage.Message
+					if msg.Unpack(query) != nil || len(msg.Questions) == 0 {
+						return
+					}
+					msg.Response = true
+					msg.Answers = []dnsmessage.Resource{{
+						Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+					}}
+					out, err := msg.Pack()
+					if err != nil || writeDNSTCP(conn, out) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	opts := DefaultOptions()
+	opts.Network.DNS.Upstream = upstream.Addr().String()
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+
+	container := newAttachedTestContainer(t, app)
+	tcpConn, err := container.DialTCP(t, "10.0.0.1:53")
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	conn := dnsTCPConn{tcpConn}
+
+	rcode, ips := resolve(t, conn, "app.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 2).To4()}, ips)
+
+	// the queries outside of our zone share a single connection to the upstream resolver
+	for i := 0; i < 2; i++ {
+		rcode, ips = resolve(t, conn, "example.com.", dnsmessage.TypeA)
+		assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+		assert.Equal(t, []net.IP{net.IPv4(1, 2, 3, 4).To4()}, ips)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+}
+
+func TestResolvConfNameserver(t *testing.T) {
+	path := t.TempDir() + "/resolv.conf"
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nsearch example.com\nnameserver 192.168.1.1\nnameserver 8.8.8.8\n"), 0644))
+	assert.Equal(t, "192.168.1.1:53", resolvConfNameserver(path))
+	assert.Equal(t, "", resolvConfNameserver(path+".missing"))
+}
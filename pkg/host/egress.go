@@ -0,0 +1,231 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// EgressDirect is the egress that dials from the host itself, using the Dialer of the TCPOptions or UDPOptions
+// if set. It is used when none of the routes match.
+const EgressDirect = "direct"
+
+// EgressDialer dials the upstream connections of an egress, through a proxy or another host for example
+type EgressDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// EgressRoute sends the flows to matching destinations through the egress with the given name.
+// All of CIDR, Ports and Domains have to match, one that is left empty matches everything.
+type EgressRoute struct {
+	CIDR  *net.IPNet
+	Ports []uint16
+	// Domains match the destinations that were rewritten to one of these hostnames, and the addresses they resolve to
+	Domains []string
+	Egress  string
+}
+
+// EgressOptions decides through which egress the flows leave, the routes are matched in order and the first match wins
+type EgressOptions struct {
+	Dialers map[string]EgressDialer
+	Routes  []EgressRoute
+}
+
+// EgressStats counts the flows that went out through an egress
+type EgressStats struct {
+	TCPConns   uint64 `json:"tcp_conns"`
+	UDPFlows   uint64 `json:"udp_flows"`
+	DialFailed uint64 `json:"dial_failed"`
+}
+
+type egressRoute struct {
+	cidr    *net.IPNet
+	ports   map[uint16]struct{}
+	domains []*resolvedHost
+	egress  *egress
+}
+
+type egress struct {
+	name  string
+	dial  EgressDialer
+	stats EgressStats
+}
+
+// egressTable is never modified after creation
+type egressTable struct {
+	direct   *egress
+	egresses map[string]*egress
+	routes   []egressRoute
+}
+
+func newEgressTable(t *TunDevice, opts EgressOptions) (*egressTable, error) {
+	out := &egressTable{
+		direct:   &egress{name: EgressDirect, dial: t.dialDirect},
+		egresses: make(map[string]*egress, len(opts.Dialers)+1),
+	}
+	out.egresses[EgressDirect] = out.direct
+
+	for name, dial := range opts.Dialers {
+		if name == EgressDirect {
+			return nil, fmt.Errorf("the %s egress can't be replaced, use the Dialer of the TCPOptions and UDPOptions instead", EgressDirect)
+		}
+		out.egresses[name] = &egress{name: name, dial: dial}
+	}
+
+	for _, route := range opts.Routes {
+		name := route.Egress
+		if name == "" {
+			name = EgressDirect
+		}
+		e, ok := out.egresses[name]
+		if !ok {
+			return nil, fmt.Errorf("there is no egress named %s", name)
+		}
+
+		r := egressRoute{cidr: route.CIDR, egress: e}
+		if len(route.Ports) > 0 {
+			r.ports = make(map[uint16]struct{}, len(route.Ports))
+			for _, port := range route.Ports {
+				r.ports[port] = struct{}{}
+			}
+		}
+		for _, domain := range route.Domains {
+			r.domains = append(r.domains, newResolvedHost(domain))
+		}
+		out.routes = append(out.routes, r)
+	}
+
+	return out, nil
+}
+
+func (r *egressRoute) matches(host string, ip net.IP, port uint16) bool {
+	if r.ports != nil {
+		if _, ok := r.ports[port]; !ok {
+			return false
+		}
+	}
+	if r.cidr != nil && (ip == nil || !r.cidr.Contains(ip)) {
+		return false
+	}
+	if r.domains == nil {
+		return true
+	}
+
+	for _, domain := range r.domains {
+		if domain.name == host || (ip != nil && domain.contains(ipAddress(ip))) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the egress for the upstream address addr
+func (e *egressTable) route(addr string) *egress {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return e.direct
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	ip := net.ParseIP(host)
+
+	for i := range e.routes {
+		if e.routes[i].matches(host, ip, uint16(port)) {
+			return e.routes[i].egress
+		}
+	}
+	return e.direct
+}
+
+// dialDirect dials from the host, so dials in progress are aborted when shutting down
+func (t *TunDevice) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dial func(network, addr string) (net.Conn, error)
+	switch network {
+	case "tcp":
+		dial = t.tcpHandler.dialer
+	case "udp":
+		dial = t.udpHandler.dialer
+	}
+	if dial != nil {
+		return dialContext(ctx, func() (net.Conn, error) {
+			return dial(network, addr)
+		})
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialContext runs dial, which doesn't take a ctx, until ctx is done. The connection is closed when it shows up
+// after ctx was cancelled.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialEgress dials addr for f through the egress its route points at, unix sockets are always dialed directly
+func (t *TunDevice) dialEgress(ctx context.Context, f *flow, network, addr string) (net.Conn, error) {
+	if network == "unix" {
+		return t.dialSpan(ctx, network, addr, t.dial)
+	}
+
+	e := t.egress.route(addr)
+	f.via = e.name
+	trace.SpanFromContext(ctx).SetAttributes(egressNameKey.String(e.name))
+
+	conn, err := t.dialSpan(ctx, network, addr, func(network, addr string) (net.Conn, error) {
+		return e.dial(t.ctx, network, addr)
+	})
+	if err != nil {
+		atomic.AddUint64(&e.stats.DialFailed, 1)
+		return nil, err
+	}
+
+	if f.proto == tcp.ProtocolNumber {
+		atomic.AddUint64(&e.stats.TCPConns, 1)
+	} else {
+		atomic.AddUint64(&e.stats.UDPFlows, 1)
+	}
+	return conn, nil
+}
+
+func (e *egressTable) snapshot() map[string]EgressStats {
+	out := make(map[string]EgressStats, len(e.egresses))
+	for name, egress := range e.egresses {
+		out[name] = EgressStats{
+			TCPConns:   atomic.LoadUint64(&egress.stats.TCPConns),
+			UDPFlows:   atomic.LoadUint64(&egress.stats.UDPFlows),
+			DialFailed: atomic.LoadUint64(&egress.stats.DialFailed),
+		}
+	}
+	return out
+}
+
+func (e *egressTable) reset() {
+	for _, egress := range e.egresses {
+		atomic.StoreUint64(&egress.stats.TCPConns, 0)
+		atomic.StoreUint64(&egress.stats.UDPFlows, 0)
+		atomic.StoreUint64(&egress.stats.DialFailed, 0)
+	}
+}
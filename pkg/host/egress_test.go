@@ -0,0 +1,121 @@
+package host
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressRoutes(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("203.0.113.0/24")
+	require.NoError(t, err)
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, net.ErrClosed
+	}
+	table, err := newEgressTable(&TunDevice{}, EgressOptions{
+		Dialers: map[string]EgressDialer{"vpn": dial, "proxy": dial},
+		Routes: []EgressRoute{
+			{CIDR: cidr, Ports: []uint16{22}, Egress: EgressDirect},
+			{CIDR: cidr, Egress: "vpn"},
+			{Domains: []string{"localhost", "example.internal"}, Egress: "proxy"},
+			{Ports: []uint16{25}, Egress: "vpn"},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, EgressDirect, table.route("203.0.113.5:22").name)
+	assert.Equal(t, "vpn", table.route("203.0.113.5:443").name)
+	assert.Equal(t, "proxy", table.route("example.internal:443").name)
+	// domains match on their resolved addresses as well
+	assert.Equal(t, "proxy", table.route("127.0.0.1:80").name)
+	assert.Equal(t, "vpn", table.route("198.51.100.1:25").name)
+	assert.Equal(t, EgressDirect, table.route("198.51.100.1:80").name)
+
+	_, err = newEgressTable(&TunDevice{}, EgressOptions{Routes: []EgressRoute{{Egress: "nope"}}})
+	assert.Error(t, err)
+	_, err = newEgressTable(&TunDevice{}, EgressOptions{Dialers: map[string]EgressDialer{EgressDirect: dial}})
+	assert.Error(t, err)
+}
+
+func TestEgress(t *testing.T) {
+	tcpPort := echoHostListener(t)
+	udpPort := udpEchoHostListener(t)
+
+	// the proxy stands in for another host, it sends everything to the echo listeners
+	var proxied uint32
+	proxy := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddUint32(&proxied, 1)
+		port := tcpPort
+		if network == "udp" {
+			port = udpPort
+		}
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, net.JoinHostPort("127.0.0.1", port))
+	}
+
+	_, cidr, err := net.ParseCIDR("203.0.113.0/24")
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.Egress = EgressOptions{
+		Dialers: map[string]EgressDialer{"proxy": proxy},
+		Routes:  []EgressRoute{{CIDR: cidr, Egress: "proxy"}},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	conn, err := container.DialTCP(t, "203.0.113.5:443")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello through the proxy")
+
+	conn, err = container.DialUDP(t, "203.0.113.6:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello over udp")
+
+	// anything else leaves directly
+	conn, err = container.DialTCP(t, net.JoinHostPort("10.0.0.100", tcpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello host")
+
+	assert.EqualValues(t, 2, atomic.LoadUint32(&proxied))
+
+	stats := tun.Snapshot().Egress
+	assert.Equal(t, EgressStats{TCPConns: 1, UDPFlows: 1}, stats["proxy"])
+	assert.Equal(t, EgressStats{TCPConns: 1}, stats[EgressDirect])
+
+	tun.ResetStats()
+	assert.Equal(t, EgressStats{}, tun.Snapshot().Egress["proxy"])
+}
+
+func TestEgressDirectDialer(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	opts := DefaultOptions()
+	opts.TCPOptions.Dialer = func(network, addr string) (net.Conn, error) {
+		<-release
+		return nil, assert.AnError
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	// a Dialer that takes forever doesn't hold up a dial that was given up on
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = tun.dialDirect(ctx, "tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
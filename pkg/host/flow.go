@@ -0,0 +1,115 @@
+package host
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// flow holds the counters of a single forwarded TCP connection or UDP association.
+// Egress is the traffic coming from the container, ingress is the traffic going towards it.
+type flow struct {
+	serial uint64
+	id     stack.TransportEndpointID
+	proto  tcpip.TransportProtocolNumber
+	start  time.Time
+
+	// closer tears down the flow, it has to be set before the flow is added to the flowTable
+	closer func() error
+	// via is the name of the egress the flow left through, it is set before the flow is added as well
+	via string
+
+	// ctx is cancelled once the flow is closed, to stop whatever is waiting on its behalf
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// these are all accessed atomically, the packets are the reads and writes of the relay. For UDP those are the
+	// datagrams, but for TCP they don't match the segments on the wire.
+	lastSeen       int64
+	egressBytes    uint64
+	egressPackets  uint64
+	ingressBytes   uint64
+	ingressPackets uint64
+
+	// only touched by the flow exporter
+	export flowExportState
+}
+
+func newFlow(proto tcpip.TransportProtocolNumber, id stack.TransportEndpointID) *flow {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &flow{
+		id:       id,
+		proto:    proto,
+		start:    now,
+		lastSeen: now.UnixNano(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (f *flow) addEgress(n int) {
+	atomic.AddUint64(&f.egressBytes, uint64(n))
+	atomic.AddUint64(&f.egressPackets, 1)
+	atomic.StoreInt64(&f.lastSeen, time.Now().UnixNano())
+}
+
+func (f *flow) addIngress(n int) {
+	atomic.AddUint64(&f.ingressBytes, uint64(n))
+	atomic.AddUint64(&f.ingressPackets, 1)
+	atomic.StoreInt64(&f.lastSeen, time.Now().UnixNano())
+}
+
+func (f *flow) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastSeen))
+}
+
+func (f *flow) Close() error {
+	f.cancel()
+	return f.closer()
+}
+
+// flowTable keeps track of all the flows that are currently being forwarded
+type flowTable struct {
+	flows  sync.Map
+	serial uint64
+
+	// ended is called for every flow that is removed from the table, if set
+	ended func(*flow)
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{}
+}
+
+func (t *flowTable) add(f *flow) {
+	f.serial = atomic.AddUint64(&t.serial, 1)
+	t.flows.Store(f, struct{}{})
+}
+
+func (t *flowTable) remove(f *flow) {
+	if _, ok := t.flows.LoadAndDelete(f); ok && t.ended != nil {
+		t.ended(f)
+	}
+}
+
+func (t *flowTable) Range(fn func(*flow) bool) {
+	t.flows.Range(func(key, _ interface{}) bool {
+		return fn(key.(*flow))
+	})
+}
+
+func (t *flowTable) find(serial uint64) (out *flow) {
+	t.Range(func(f *flow) bool {
+		if f.serial == serial {
+			out = f
+			return false
+		}
+		return true
+	})
+	return out
+}
@@ -0,0 +1,83 @@
+package host
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+type PacketDirection int
+
+const (
+	// PacketFromContainer are the packets read from the bridge, before they are delivered to the stack
+	PacketFromContainer PacketDirection = iota
+	// PacketToContainer are the packets written by the stack, before they are written to the bridge
+	PacketToContainer
+)
+
+type PacketVerdict int
+
+const (
+	PacketAccept PacketVerdict = iota
+	PacketDrop
+)
+
+// PacketHook gets to see every raw IP packet going to or coming from the container, hooks are called in
+// the order they are specified in Options.PacketHooks and a drop verdict stops any later hooks from running.
+//
+// The rules for the ownership of the stack.PacketBuffer are as follows:
+//   - pkt remains owned by nsnet, a hook must never call DecRef() on it and must not use it after returning.
+//     If a hook wants to hold on to the packet it has to make its own copy, using PacketBytes() for example.
+//   - pkt must not be modified in place, its underlying memory may be shared with the stack (for TCP retransmits
+//     for example). To modify a packet a hook returns a new buffer instead, see NewPacket(). Ownership of the
+//     returned buffer is transferred to nsnet and later hooks will see the new buffer instead.
+//   - Returning nil or pkt itself as the buffer leaves the packet as is.
+type PacketHook interface {
+	HandlePacket(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer)
+}
+
+// PacketHookFunc allows you to use an ordinary function as a PacketHook
+type PacketHookFunc func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer)
+
+func (f PacketHookFunc) HandlePacket(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+	return f(dir, pkt)
+}
+
+// PacketBytes returns a copy of the entire packet, starting at the IP header
+func PacketBytes(pkt *stack.PacketBuffer) []byte {
+	vv := buffer.NewVectorisedView(pkt.Size(), pkt.Views())
+	// with a single view ToView returns the storage of the packet itself
+	return append([]byte(nil), vv.ToView()...)
+}
+
+// NewPacket creates a new packet buffer out of a raw IP packet, to be returned from a PacketHook
+func NewPacket(data []byte) *stack.PacketBuffer {
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewVectorisedView(len(data), []buffer.View{buffer.NewViewFromBytes(data)}),
+	})
+}
+
+// runPacketHooks returns the packet to continue with, or nil if it has to be dropped.
+// Any buffers returned by the hooks are released here, except for the one that is returned.
+func (t *TunDevice) runPacketHooks(dir PacketDirection, pkt *stack.PacketBuffer) *stack.PacketBuffer {
+	orig := pkt
+	release := func() {
+		if pkt != orig {
+			pkt.DecRef()
+		}
+	}
+
+	for _, hook := range t.packetHooks {
+		verdict, replacement := hook.HandlePacket(dir, pkt)
+		if replacement != nil && replacement != pkt {
+			release()
+			pkt = replacement
+		}
+
+		if verdict == PacketDrop {
+			release()
+			return nil
+		}
+	}
+
+	return pkt
+}
@@ -0,0 +1,166 @@
+package host
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func echoHostListener(t *testing.T) string {
+	listener, port := hostListener(t)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return port
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, string(buf))
+}
+
+func TestPacketHooks(t *testing.T) {
+	var from, to, copied int32
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.PacketHooks = []PacketHook{
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			if dir == PacketFromContainer {
+				atomic.AddInt32(&from, 1)
+			} else {
+				atomic.AddInt32(&to, 1)
+			}
+			return PacketAccept, nil
+		}),
+		// replaces every packet with an identical copy, which should be invisible to both ends
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			atomic.AddInt32(&copied, 1)
+			return PacketAccept, NewPacket(PacketBytes(pkt))
+		}),
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	echo(t, conn, "hello")
+
+	assert.Greater(t, atomic.LoadInt32(&from), int32(0))
+	assert.Greater(t, atomic.LoadInt32(&to), int32(0))
+	assert.Equal(t, atomic.LoadInt32(&from)+atomic.LoadInt32(&to), atomic.LoadInt32(&copied))
+}
+
+func TestPacketHookDrop(t *testing.T) {
+	var dropped int32
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.PacketHooks = []PacketHook{
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			if dir == PacketFromContainer && header.IPv4(PacketBytes(pkt)).Protocol() == uint8(header.TCPProtocolNumber) {
+				atomic.AddInt32(&dropped, 1)
+				return PacketDrop, nil
+			}
+			return PacketAccept, nil
+		}),
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			if dir == PacketFromContainer {
+				t.Error("hooks after a drop shouldn't be called")
+			}
+			return PacketAccept, nil
+		}),
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("the connection should never complete, got %v", err)
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	assert.Greater(t, atomic.LoadInt32(&dropped), int32(0))
+	assert.Equal(t, uint32(0), tun.Snapshot().TCP.Conns)
+}
+
+func TestPacketBytes(t *testing.T) {
+	var packets, wrongSize, shared int32
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.PacketHooks = []PacketHook{
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			data := PacketBytes(pkt)
+			if header.IPVersion(data) != header.IPv4Version {
+				return PacketAccept, nil
+			}
+			atomic.AddInt32(&packets, 1)
+			if len(data) != int(header.IPv4(data).TotalLength()) {
+				atomic.AddInt32(&wrongSize, 1)
+			}
+
+			// the copy is ours to modify, the packet itself stays the same
+			data[len(data)-1]++
+			if PacketBytes(pkt)[len(data)-1] == data[len(data)-1] {
+				atomic.AddInt32(&shared, 1)
+			}
+			return PacketAccept, nil
+		}),
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello")
+
+	assert.Greater(t, atomic.LoadInt32(&packets), int32(0))
+	assert.Zero(t, atomic.LoadInt32(&wrongSize))
+	assert.Zero(t, atomic.LoadInt32(&shared))
+}
@@ -0,0 +1,280 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// how long we wait for the host to answer an echo request to an alias
+const hostAliasEchoTimeout = time.Second * 2
+
+// HostAlias makes an address of the host reachable from the container at a virtual address, for TCP, UDP and
+// ICMP echo. Connections to ports that aren't allowed are refused, just like a closed port would be. Echo requests
+// are sent on to the host address over an unprivileged ping socket, see net.ipv4.ping_group_range, so they go
+// unanswered when those aren't allowed.
+type HostAlias struct {
+	Virtual net.IP `json:"virtual"`
+	Host    net.IP `json:"host"`
+	// Ports are the ports the container is allowed to reach, all ports are allowed when empty
+	Ports []uint16 `json:"ports,omitempty"`
+}
+
+type hostAlias struct {
+	host  tcpip.Address
+	ports map[uint16]struct{}
+}
+
+// hostAliases are the aliases by their virtual address, it is never modified after creation
+type hostAliases struct {
+	list    []HostAlias
+	aliases map[tcpip.Address]hostAlias
+}
+
+// newHostAliases sets up the aliases, allowHost adds the alias of 10.0.0.100 to 127.0.0.1 unless it is in aliases already
+func newHostAliases(aliases []HostAlias, allowHost bool) (*hostAliases, error) {
+	out := &hostAliases{
+		aliases: make(map[tcpip.Address]hostAlias, len(aliases)+1),
+	}
+
+	for _, alias := range aliases {
+		if alias.Virtual == nil || alias.Host == nil {
+			return nil, fmt.Errorf("host alias %s -> %s is missing an address", alias.Virtual, alias.Host)
+		}
+		virtual := ipAddress(alias.Virtual)
+		if _, ok := out.aliases[virtual]; ok {
+			return nil, fmt.Errorf("there already is a host alias for %s", alias.Virtual)
+		}
+
+		a := hostAlias{host: ipAddress(alias.Host)}
+		if len(alias.Ports) > 0 {
+			a.ports = make(map[uint16]struct{}, len(alias.Ports))
+			for _, port := range alias.Ports {
+				a.ports[port] = struct{}{}
+			}
+		}
+		out.aliases[virtual] = a
+		out.list = append(out.list, alias)
+	}
+
+	if _, ok := out.aliases[fakeLocal]; allowHost && !ok {
+		loopback := net.IPv4(127, 0, 0, 1).To4()
+		out.aliases[fakeLocal] = hostAlias{host: tcpip.Address(loopback)}
+		out.list = append(out.list, HostAlias{Virtual: net.IP(fakeLocal), Host: loopback})
+	}
+
+	return out, nil
+}
+
+// rewrite returns the address to dial for addr:port, which is addr itself if it isn't an alias.
+// It returns false if addr is an alias, but port isn't allowed.
+func (h *hostAliases) rewrite(addr tcpip.Address, port uint16) (tcpip.Address, bool) {
+	alias, ok := h.aliases[addr]
+	if !ok {
+		return addr, true
+	}
+	if alias.ports != nil {
+		if _, ok := alias.ports[port]; !ok {
+			return "", false
+		}
+	}
+	return alias.host, true
+}
+
+// HostAliases returns the host aliases in effect, including the one of AllowHostConnections
+func (t *TunDevice) HostAliases() []HostAlias {
+	return append([]HostAlias(nil), t.hostAliases.list...)
+}
+
+// loopback returns the virtual addresses of the aliases of the host loopback
+func (h *hostAliases) loopback() []net.IP {
+	var out []net.IP
+	for _, alias := range h.list {
+		if alias.Host.IsLoopback() {
+			out = append(out, alias.Virtual)
+		}
+	}
+	return out
+}
+
+// echoRequest is an ICMP echo request from a container to a host alias
+type echoRequest struct {
+	version  int
+	src, dst tcpip.Address
+	host     tcpip.Address
+	ident    uint16
+	seq      uint16
+	payload  []byte
+}
+
+// echoRequest returns the echo request in pkt, if it is one for an alias
+func (h *hostAliases) echoRequest(pkt *stack.PacketBuffer, version int) (echoRequest, bool) {
+	out := echoRequest{version: version}
+	if len(h.aliases) == 0 {
+		return out, false
+	}
+
+	v, ok := pkt.Data().PullUp(pkt.Data().Size())
+	if !ok {
+		return out, false
+	}
+
+	switch version {
+	case header.IPv4Version:
+		if len(v) < header.IPv4MinimumSize {
+			return out, false
+		}
+		ip := header.IPv4(v)
+		hlen, total := int(ip.HeaderLength()), int(ip.TotalLength())
+		if ip.TransportProtocol() != header.ICMPv4ProtocolNumber || hlen < header.IPv4MinimumSize || total > len(v) || total < hlen+header.ICMPv4MinimumSize {
+			return out, false
+		}
+		msg := header.ICMPv4(v[hlen:total])
+		if msg.Type() != header.ICMPv4Echo {
+			return out, false
+		}
+		out.src, out.dst = ip.SourceAddress(), ip.DestinationAddress()
+		out.ident, out.seq, out.payload = msg.Ident(), msg.Sequence(), msg.Payload()
+	case header.IPv6Version:
+		if len(v) < header.IPv6MinimumSize {
+			return out, false
+		}
+		ip := header.IPv6(v)
+		total := header.IPv6MinimumSize + int(ip.PayloadLength())
+		if ip.TransportProtocol() != header.ICMPv6ProtocolNumber || total > len(v) || total < header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize {
+			return out, false
+		}
+		msg := header.ICMPv6(v[header.IPv6MinimumSize:total])
+		if msg.Type() != header.ICMPv6EchoRequest {
+			return out, false
+		}
+		out.src, out.dst = ip.SourceAddress(), ip.DestinationAddress()
+		out.ident, out.seq, out.payload = msg.Ident(), msg.Sequence(), msg.Payload()
+	default:
+		return out, false
+	}
+
+	alias, ok := h.aliases[out.dst]
+	if !ok {
+		return out, false
+	}
+	out.host = alias.host
+	// the packet is released once we return
+	out.payload = append([]byte(nil), out.payload...)
+	return out, true
+}
+
+// echoHostAlias sends req on to the host and answers the container once the host did
+func (t *TunDevice) echoHostAlias(a *Attachment, req echoRequest) {
+	defer t.wg.Done()
+
+	if err := t.pingHost(req); err != nil {
+		// no reply, just like an address that doesn't answer
+		return
+	}
+
+	reply := echoReply(req)
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(reply).ToVectorisedView()})
+	defer pkb.DecRef()
+	_ = a.writePacket(pkb)
+}
+
+// pingHost sends an echo request to the host address of req and waits for the reply
+func (t *TunDevice) pingHost(req echoRequest) error {
+	network, proto := "udp4", 1
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if req.version == header.IPv6Version {
+		network, proto, typ = "udp6", 58, ipv6.ICMPTypeEchoRequest
+	}
+
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the kernel picks the identifier of a ping socket itself, so the sequence is what we match on
+	msg, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{Seq: int(req.seq), Data: req.payload}}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-t.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.WriteTo(msg, &net.UDPAddr{IP: net.IP(req.host)}); err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(hostAliasEchoTimeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(msg)+header.IPv6MinimumSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && (reply.Type == ipv4.ICMPTypeEchoReply || reply.Type == ipv6.ICMPTypeEchoReply) && echo.Seq == int(req.seq) {
+			return nil
+		}
+	}
+}
+
+// echoReply builds the reply of the alias to req
+func echoReply(req echoRequest) []byte {
+	if req.version == header.IPv6Version {
+		buf := make([]byte, header.IPv6MinimumSize+header.ICMPv6EchoMinimumSize+len(req.payload))
+		header.IPv6(buf).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(buf) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           req.dst,
+			DstAddr:           req.src,
+		})
+		msg := header.ICMPv6(buf[header.IPv6MinimumSize:])
+		msg.SetType(header.ICMPv6EchoReply)
+		msg.SetIdent(req.ident)
+		msg.SetSequence(req.seq)
+		copy(msg.Payload(), req.payload)
+		msg.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: msg, Src: req.dst, Dst: req.src}))
+		return buf
+	}
+
+	buf := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(req.payload))
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     req.dst,
+		DstAddr:     req.src,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	msg := header.ICMPv4(buf[header.IPv4MinimumSize:])
+	msg.SetType(header.ICMPv4EchoReply)
+	msg.SetIdent(req.ident)
+	msg.SetSequence(req.seq)
+	copy(msg.Payload(), req.payload)
+	msg.SetChecksum(header.ICMPv4Checksum(msg, 0))
+	return buf
+}
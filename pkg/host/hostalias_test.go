@@ -0,0 +1,120 @@
+package host
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func udpEchoHostListener(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+	return port
+}
+
+func TestHostAliasesRewrite(t *testing.T) {
+	aliases, err := newHostAliases([]HostAlias{
+		{Virtual: net.IPv4(10, 0, 0, 101), Host: net.IPv4(127, 0, 0, 53), Ports: []uint16{53}},
+	}, true)
+	require.NoError(t, err)
+
+	addr, ok := aliases.rewrite(tcpip.Address(net.IPv4(10, 0, 0, 101).To4()), 53)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.53", addr.String())
+	_, ok = aliases.rewrite(tcpip.Address(net.IPv4(10, 0, 0, 101).To4()), 22)
+	assert.False(t, ok)
+
+	addr, ok = aliases.rewrite(fakeLocal, 22)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", addr.String())
+
+	addr, ok = aliases.rewrite(tcpip.Address(net.IPv4(1, 1, 1, 1).To4()), 22)
+	assert.True(t, ok)
+	assert.Equal(t, "1.1.1.1", addr.String())
+
+	_, err = newHostAliases([]HostAlias{
+		{Virtual: net.IPv4(10, 0, 0, 101), Host: net.IPv4(127, 0, 0, 1)},
+		{Virtual: net.IPv4(10, 0, 0, 101), Host: net.IPv4(127, 0, 0, 2)},
+	}, false)
+	assert.Error(t, err)
+}
+
+func TestHostAliases(t *testing.T) {
+	tcpPort := echoHostListener(t)
+	udpPort := udpEchoHostListener(t)
+	p, err := strconv.Atoi(tcpPort)
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.HostAliases = []HostAlias{
+		{Virtual: net.IPv4(10, 0, 0, 101), Host: net.IPv4(127, 0, 0, 1), Ports: []uint16{uint16(p)}},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	// udp reaches the host loopback just like tcp does
+	conn, err := container.DialUDP(t, net.JoinHostPort("10.0.0.100", udpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "udp to the host")
+
+	conn, err = container.DialTCP(t, net.JoinHostPort("10.0.0.101", tcpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "tcp to an allowed port")
+
+	// the other ports aren't on the allowlist of this alias
+	unreachable(t, container, net.JoinHostPort("10.0.0.101", udpPort))
+	sent := tun.Snapshot().UDP
+	conn, err = container.DialUDP(t, net.JoinHostPort("10.0.0.101", udpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("anyone there?"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Millisecond*200)))
+	_, err = conn.Read(make([]byte, 100))
+	assert.Error(t, err)
+	assert.NotZero(t, tun.Snapshot().Drops.Policy)
+	// the refused datagram was never sent anywhere
+	assert.Equal(t, sent.SentPacket, tun.Snapshot().UDP.SentPacket)
+	assert.Equal(t, sent.SentBytes, tun.Snapshot().UDP.SentBytes)
+
+	assert.Len(t, tun.HostAliases(), 2)
+
+	// echo requests go to the host over a ping socket, the stack never sees them
+	if conn, err := icmp.ListenPacket("udp4", ""); err == nil {
+		conn.Close()
+		assert.NoError(t, container.Ping(t, "10.0.0.100"))
+		assert.NoError(t, container.Ping(t, "10.0.0.101"))
+	} else {
+		// without ping sockets there is no telling whether the host answers, so neither do we
+		assert.Error(t, container.Ping(t, "10.0.0.100"))
+		assert.Error(t, container.Ping(t, "10.0.0.101"))
+	}
+	assert.Zero(t, tun.stack.Stats().ICMP.V4.PacketsReceived.EchoRequest.Value())
+}
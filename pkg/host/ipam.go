@@ -0,0 +1,367 @@
+package host
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNoAddressesLeft is returned when all the addresses of a subnet are in use
+var ErrNoAddressesLeft = errors.New("no addresses left in the subnet")
+
+// how many addresses of an IPv6 subnet we consider before giving up, scanning all of them isn't feasible
+const maxAddressScan = 1 << 16
+
+// lease is what we persist in the lease file for every attachment name
+type lease struct {
+	IPv4 net.IP `json:"ipv4,omitempty"`
+	IPv6 net.IP `json:"ipv6,omitempty"`
+}
+
+// addressPool hands out the addresses of a single subnet, the first address is the gateway
+type addressPool struct {
+	subnet  *net.IPNet
+	gateway net.IP
+	used    map[string]string
+}
+
+func newAddressPool(subnet *net.IPNet) *addressPool {
+	base := subnet.IP.Mask(subnet.Mask)
+	if ip4 := base.To4(); ip4 != nil {
+		base = ip4
+	}
+
+	return &addressPool{
+		subnet:  &net.IPNet{IP: base, Mask: subnet.Mask},
+		gateway: addToIP(base, 1),
+		used:    make(map[string]string),
+	}
+}
+
+func addToIP(ip net.IP, n int64) net.IP {
+	v := new(big.Int).SetBytes(ip)
+	v.Add(v, big.NewInt(n))
+
+	out := make(net.IP, len(ip))
+	b := v.Bytes()
+	if len(b) > len(out) {
+		return nil
+	}
+	copy(out[len(out)-len(b):], b)
+	return out
+}
+
+func (p *addressPool) contains(ip net.IP) bool {
+	return p.subnet.Contains(ip)
+}
+
+// usable is false for the network, gateway and broadcast addresses
+func (p *addressPool) usable(ip net.IP) bool {
+	if !p.contains(ip) || ip.Equal(p.subnet.IP) || ip.Equal(p.gateway) {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		broadcast := make(net.IP, len(ip4))
+		for i := range ip4 {
+			broadcast[i] = p.subnet.IP[i] | ^p.subnet.Mask[i]
+		}
+		return !ip4.Equal(broadcast)
+	}
+	return true
+}
+
+// next returns the first free address that isn't in avoid, if there's none it returns the first free one in avoid
+func (p *addressPool) next(avoid map[string]bool) (net.IP, error) {
+	var fallback net.IP
+	for i := int64(2); i < maxAddressScan; i++ {
+		ip := addToIP(p.subnet.IP, i)
+		if ip == nil || !p.contains(ip) {
+			break
+		}
+		if !p.usable(ip) {
+			continue
+		}
+		if _, ok := p.used[ip.String()]; ok {
+			continue
+		}
+		if !avoid[ip.String()] {
+			return ip, nil
+		}
+		if fallback == nil {
+			fallback = ip
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, ErrNoAddressesLeft
+}
+
+// ipam assigns the addresses to the attachments of a Network. Static reservations are never handed out to
+// anybody else, while previous leases are only reused for other names once everything else is taken.
+type ipam struct {
+	mutex sync.Mutex
+
+	v4 *addressPool
+	v6 *addressPool
+
+	reservations map[string][]net.IP
+	leases       map[string]lease
+	leaseFile    string
+
+	// virtual counts the services, virtual listeners and host aliases that use an address of the subnet,
+	// these addresses are marked as used by virtualOwner so they're never handed out
+	virtual map[string]int
+}
+
+const virtualOwner = "a virtual service"
+
+func newIPAM(opts NetworkOptions) (*ipam, error) {
+	if opts.Subnet == nil || opts.Subnet.IP.To4() == nil {
+		return nil, errors.New("an IPv4 subnet is required for a network")
+	}
+
+	out := &ipam{
+		v4:           newAddressPool(opts.Subnet),
+		reservations: opts.Reservations,
+		leases:       make(map[string]lease),
+		leaseFile:    opts.LeaseFile,
+		virtual:      make(map[string]int),
+	}
+	if opts.Subnet6 != nil {
+		if opts.Subnet6.IP.To4() != nil {
+			return nil, fmt.Errorf("%s is not an IPv6 subnet", opts.Subnet6)
+		}
+		out.v6 = newAddressPool(opts.Subnet6)
+	}
+
+	for name, addrs := range opts.Reservations {
+		for _, addr := range addrs {
+			if out.pool(addr) == nil || !out.pool(addr).usable(addr) {
+				return nil, fmt.Errorf("the reservation %s for %s is not a usable address of the network", addr, name)
+			}
+		}
+	}
+
+	if out.leaseFile != "" {
+		data, err := os.ReadFile(out.leaseFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		} else if err == nil {
+			if err := json.Unmarshal(data, &out.leases); err != nil {
+				return nil, fmt.Errorf("parsing the lease file: %w", err)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (m *ipam) pool(ip net.IP) *addressPool {
+	if ip.To4() != nil {
+		return m.v4
+	}
+	return m.v6
+}
+
+// reserved returns the reservation of name in the pool, or nil
+func (m *ipam) reserved(name string, pool *addressPool) net.IP {
+	for _, addr := range m.reservations[name] {
+		if pool.contains(addr) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// taken returns whether ip is reserved for a name other than name
+func (m *ipam) taken(name string, ip net.IP) bool {
+	for other, addrs := range m.reservations {
+		if other == name {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *ipam) allocateFrom(name string, pool *addressPool, requested, leased net.IP) (net.IP, error) {
+	if requested == nil {
+		requested = m.reserved(name, pool)
+	}
+	if requested != nil {
+		if !pool.usable(requested) {
+			return nil, fmt.Errorf("%s is not a usable address in %s", requested, pool.subnet)
+		} else if owner, ok := pool.used[requested.String()]; ok {
+			return nil, fmt.Errorf("%s is already in use by %s", requested, owner)
+		} else if m.taken(name, requested) {
+			return nil, fmt.Errorf("%s is reserved for another attachment", requested)
+		}
+		return requested, nil
+	}
+
+	if leased != nil && pool.usable(leased) && !m.taken(name, leased) {
+		if _, ok := pool.used[leased.String()]; !ok {
+			return leased, nil
+		}
+	}
+
+	avoid := make(map[string]bool)
+	for _, addrs := range m.reservations {
+		for _, addr := range addrs {
+			avoid[addr.String()] = true
+		}
+	}
+	for other, l := range m.leases {
+		if other != name {
+			avoid[l.IPv4.String()] = true
+			avoid[l.IPv6.String()] = true
+		}
+	}
+
+	ip, err := pool.next(avoid)
+	if err != nil {
+		return nil, err
+	}
+	// we may only fall back on the leases of others, never on reservations
+	if m.taken(name, ip) {
+		return nil, ErrNoAddressesLeft
+	}
+	return ip, nil
+}
+
+// allocate assigns an IPv4 address to name, and an IPv6 address if the network has an IPv6 subnet.
+// If requested is set that address is used, otherwise a reservation or previous lease takes precedence.
+func (m *ipam) allocate(name string, requested net.IP) (v4 net.IP, v6 net.IP, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var requested4, requested6 net.IP
+	if requested != nil {
+		if requested.To4() != nil {
+			requested4 = requested.To4()
+		} else if m.v6 != nil {
+			requested6 = requested
+		} else {
+			return nil, nil, fmt.Errorf("%s is not an IPv4 address and the network has no IPv6 subnet", requested)
+		}
+	}
+
+	previous := m.leases[name]
+	v4, err = m.allocateFrom(name, m.v4, requested4, previous.IPv4)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.v6 != nil {
+		v6, err = m.allocateFrom(name, m.v6, requested6, previous.IPv6)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m.v4.used[v4.String()] = name
+	if v6 != nil {
+		m.v6.used[v6.String()] = name
+	}
+
+	m.leases[name] = lease{IPv4: v4, IPv6: v6}
+	if err := m.save(); err != nil {
+		m.releaseLocked(v4, v6)
+		return nil, nil, err
+	}
+
+	return v4, v6, nil
+}
+
+// release makes the addresses available again, the lease is kept so the same name gets the same addresses
+func (m *ipam) release(v4, v6 net.IP) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.releaseLocked(v4, v6)
+}
+
+func (m *ipam) releaseLocked(v4, v6 net.IP) {
+	if v4 != nil {
+		delete(m.v4.used, v4.String())
+	}
+	if v6 != nil && m.v6 != nil {
+		delete(m.v6.used, v6.String())
+	}
+}
+
+// claimVirtual keeps ip from being assigned to an attachment, as long as a service, virtual listener, host
+// alias or unix socket uses it. Addresses outside of the subnets don't need this.
+func (m *ipam) claimVirtual(ip net.IP) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pool := m.pool(ip)
+	if pool == nil || !pool.contains(ip) {
+		return nil
+	}
+	key := ip.String()
+	if owner, ok := pool.used[key]; ok && owner != virtualOwner {
+		return fmt.Errorf("%s is already in use by %s", ip, owner)
+	} else if m.taken("", ip) {
+		return fmt.Errorf("%s is reserved for an attachment", ip)
+	}
+
+	pool.used[key] = virtualOwner
+	m.virtual[key]++
+	return nil
+}
+
+// releaseVirtual undoes claimVirtual
+func (m *ipam) releaseVirtual(ip net.IP) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := ip.String()
+	if _, ok := m.virtual[key]; !ok {
+		return
+	}
+	m.virtual[key]--
+	if m.virtual[key] == 0 {
+		delete(m.virtual, key)
+		delete(m.pool(ip).used, key)
+	}
+}
+
+// save writes the leases to the lease file, through a rename so it's never half written
+func (m *ipam) save() error {
+	if m.leaseFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.leaseFile), filepath.Base(m.leaseFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.leaseFile)
+}
@@ -0,0 +1,171 @@
+package host
+
+import (
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	require.NoError(t, err)
+	return subnet
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	m, err := newIPAM(NetworkOptions{
+		Subnet:  mustCIDR(t, "10.0.0.0/24"),
+		Subnet6: mustCIDR(t, "fd00::/64"),
+		Reservations: map[string][]net.IP{
+			"db": {net.ParseIP("10.0.0.2")},
+		},
+	})
+	require.NoError(t, err)
+
+	// the reservation of db is skipped
+	v4, v6, err := m.allocate("app", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", v4.String())
+	assert.Equal(t, "fd00::2", v6.String())
+
+	v4, _, err = m.allocate("db", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", v4.String())
+
+	_, _, err = m.allocate("other", net.ParseIP("10.0.0.3"))
+	assert.Error(t, err, "in use")
+	_, _, err = m.allocate("other", net.ParseIP("10.0.0.1"))
+	assert.Error(t, err, "gateway")
+	_, _, err = m.allocate("other", net.ParseIP("10.0.0.255"))
+	assert.Error(t, err, "broadcast")
+	_, _, err = m.allocate("other", net.ParseIP("10.0.1.2"))
+	assert.Error(t, err, "outside of the subnet")
+
+	v4, v6, err = m.allocate("other", net.ParseIP("10.0.0.10"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.10", v4.String())
+	assert.Equal(t, "fd00::4", v6.String())
+}
+
+func TestIPAMRelease(t *testing.T) {
+	m, err := newIPAM(NetworkOptions{Subnet: mustCIDR(t, "10.0.0.0/29")})
+	require.NoError(t, err)
+
+	// 10.0.0.2 up to 10.0.0.6 are usable
+	for i := 2; i <= 6; i++ {
+		v4, _, err := m.allocate(string(rune('a'+i)), nil)
+		require.NoError(t, err)
+		assert.Equal(t, net.IPv4(10, 0, 0, byte(i)).To4(), v4)
+	}
+
+	_, _, err = m.allocate("full", nil)
+	assert.ErrorIs(t, err, ErrNoAddressesLeft)
+
+	// once released the address of a name is taken by somebody else only when nothing else is left
+	m.release(net.ParseIP("10.0.0.3").To4(), nil)
+	v4, _, err := m.allocate("full", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", v4.String())
+}
+
+func TestIPAMLeaseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	opts := NetworkOptions{
+		Subnet:    mustCIDR(t, "10.0.0.0/24"),
+		LeaseFile: path,
+	}
+
+	m, err := newIPAM(opts)
+	require.NoError(t, err)
+	_, _, err = m.allocate("app", nil)
+	require.NoError(t, err)
+	db, _, err := m.allocate("db", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", db.String())
+
+	// after a restart db gets its previous address back, even when it's the first to ask
+	m, err = newIPAM(opts)
+	require.NoError(t, err)
+	v4, _, err := m.allocate("db", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", v4.String())
+
+	// while new names stay clear of the leased addresses
+	v4, _, err = m.allocate("cache", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.4", v4.String())
+}
+
+func TestNetworkEnvironment(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.Subnet6 = mustCIDR(t, "fd00::/64")
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	a, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", a.Addr().String())
+	assert.Equal(t, "fd00::2", a.Addr6().String())
+
+	cmd := exec.Command("true")
+	a.AttachToCmd(cmd)
+	assert.Subset(t, cmd.Env, []string{
+		"NSNET_ADDR=10.0.0.2/24",
+		"NSNET_GATEWAY=10.0.0.1",
+		"NSNET_ADDR6=fd00::2/64",
+		"NSNET_GATEWAY6=fd00::1",
+	})
+	// the environment of our own process is inherited as before
+	assert.Greater(t, len(cmd.Env), 4)
+
+	// closing the attachment releases the addresses, which app gets back when it returns
+	require.NoError(t, a.Close())
+	_, err = network.NewAttachment("db", net.ParseIP("10.0.0.2"))
+	require.NoError(t, err)
+	a, err = network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", a.Addr().String())
+}
+
+func TestIPAMVirtualAddresses(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.TCPOptions.UnixSockets = map[string]string{
+		"10.0.0.60:2375": "/var/run/docker.sock",
+		"10.0.0.60:2376": "/var/run/docker.sock",
+	}
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	require.NoError(t, network.AddService(Service{VIP: "10.0.0.50:80", Backends: []string{"127.0.0.1:1"}}))
+	listener, err := network.Listen("tcp", "10.0.0.2:80")
+	require.NoError(t, err)
+
+	// the addresses of services, virtual listeners, host aliases and unix sockets are never given to a container
+	for _, addr := range []string{"10.0.0.50", "10.0.0.2", "10.0.0.100", "10.0.0.60"} {
+		_, err = network.NewAttachment("app", net.ParseIP(addr))
+		assert.Error(t, err, addr)
+	}
+	a, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.3", a.Addr().String())
+
+	// nor the other way around
+	_, err = network.Listen("tcp", "10.0.0.3:80")
+	assert.Error(t, err)
+	assert.Error(t, network.AddService(Service{VIP: "10.0.0.3:80", Backends: []string{"127.0.0.1:1"}}))
+
+	// the address is free again once nothing uses it anymore
+	require.NoError(t, listener.Close())
+	_, err = network.NewAttachment("db", net.ParseIP("10.0.0.2"))
+	assert.NoError(t, err)
+	require.NoError(t, network.RemoveService("10.0.0.50:80"))
+	_, err = network.NewAttachment("cache", net.ParseIP("10.0.0.50"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,379 @@
+package host
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FlowExportOptions configures the export of IPFIX (RFC 7011) flow records to a collector over UDP.
+// Flow export is disabled when Collector is empty. The records carry the bytes of either direction but no packet
+// counts, as the flows are counted by the relay rather than on the wire.
+type FlowExportOptions struct {
+	Collector         string
+	ActiveTimeout     time.Duration
+	IdleTimeout       time.Duration
+	ObservationDomain uint32
+}
+
+const (
+	ipfixVersion        = 10
+	ipfixTemplateSetID  = 2
+	ipfixTemplateIPv4   = 256
+	ipfixTemplateIPv6   = 257
+	ipfixMaxMessageSize = 1400
+
+	ipfixHeaderSize    = 16
+	ipfixSetHeaderSize = 4
+)
+
+// flowEndReason as defined by https://www.iana.org/assignments/ipfix/ipfix.xhtml
+const (
+	flowEndIdleTimeout   = 0x01
+	flowEndActiveTimeout = 0x02
+	flowEndOfFlow        = 0x03
+)
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// the fields after the addresses are shared between both templates
+var ipfixCommonFields = []ipfixField{
+	{7, 2},   // sourceTransportPort
+	{11, 2},  // destinationTransportPort
+	{4, 1},   // protocolIdentifier
+	{1, 8},   // octetDeltaCount
+	{152, 8}, // flowStartMilliseconds
+	{153, 8}, // flowEndMilliseconds
+	{136, 1}, // flowEndReason
+}
+
+var ipfixTemplates = map[uint16][]ipfixField{
+	ipfixTemplateIPv4: append([]ipfixField{
+		{8, 4},  // sourceIPv4Address
+		{12, 4}, // destinationIPv4Address
+	}, ipfixCommonFields...),
+	ipfixTemplateIPv6: append([]ipfixField{
+		{27, 16}, // sourceIPv6Address
+		{28, 16}, // destinationIPv6Address
+	}, ipfixCommonFields...),
+}
+
+func ipfixRecordLength(template uint16) int {
+	n := 0
+	for _, field := range ipfixTemplates[template] {
+		n += int(field.length)
+	}
+	return n
+}
+
+// flowExportState is what the exporter remembers of a flow between two exports
+type flowExportState struct {
+	recordStart    time.Time
+	egressBytes    uint64
+	egressPackets  uint64
+	ingressBytes   uint64
+	ingressPackets uint64
+	exported       bool
+}
+
+type flowRecord struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	proto            uint8
+	bytes            uint64
+	start, end       time.Time
+	reason           uint8
+}
+
+func (r *flowRecord) template() uint16 {
+	if r.src.To4() != nil {
+		return ipfixTemplateIPv4
+	}
+	return ipfixTemplateIPv6
+}
+
+type flowExporter struct {
+	conn  net.Conn
+	flows *flowTable
+	opts  FlowExportOptions
+
+	sequence uint32
+
+	mutex sync.Mutex
+	ended []*flow
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newFlowExporter(flows *flowTable, opts FlowExportOptions) (*flowExporter, error) {
+	conn, err := net.Dial("udp", opts.Collector)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &flowExporter{
+		conn:  conn,
+		flows: flows,
+		opts:  opts,
+		stop:  make(chan struct{}),
+	}
+	flows.ended = out.flowEnded
+
+	interval := opts.IdleTimeout
+	if opts.ActiveTimeout < interval {
+		interval = opts.ActiveTimeout
+	}
+	interval /= 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	out.wg.Add(1)
+	go out.loop(interval)
+
+	return out, nil
+}
+
+func (e *flowExporter) Close() error {
+	close(e.stop)
+	e.wg.Wait()
+	return e.conn.Close()
+}
+
+func (e *flowExporter) flowEnded(f *flow) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.ended = append(e.ended, f)
+}
+
+func (e *flowExporter) loop(interval time.Duration) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			// we flush whatever we have left, so no traffic goes unaccounted
+			e.export(time.Now(), true)
+			return
+		case now := <-ticker.C:
+			e.export(now, false)
+		}
+	}
+}
+
+func (e *flowExporter) export(now time.Time, final bool) {
+	var records []flowRecord
+
+	e.flows.Range(func(f *flow) bool {
+		lastSeen := f.LastSeen()
+		switch {
+		case final:
+			records = e.collect(records, f, lastSeen, flowEndOfFlow)
+		case now.Sub(lastSeen) >= e.opts.IdleTimeout:
+			records = e.collect(records, f, lastSeen, flowEndIdleTimeout)
+		case now.Sub(e.recordStart(f)) >= e.opts.ActiveTimeout:
+			records = e.collect(records, f, now, flowEndActiveTimeout)
+		}
+		return true
+	})
+
+	e.mutex.Lock()
+	ended := e.ended
+	e.ended = nil
+	e.mutex.Unlock()
+
+	for _, f := range ended {
+		records = e.collect(records, f, f.LastSeen(), flowEndOfFlow)
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	for _, msg := range e.encode(now, records) {
+		if _, err := e.conn.Write(msg); err != nil {
+			logrus.Warnf("Failed to export flows: %s", err)
+			return
+		}
+	}
+}
+
+func (e *flowExporter) recordStart(f *flow) time.Time {
+	if f.export.recordStart.IsZero() {
+		return f.start
+	}
+	return f.export.recordStart
+}
+
+// collect turns the counters gathered since the previous export of f into records, one per direction
+// that saw traffic
+func (e *flowExporter) collect(records []flowRecord, f *flow, end time.Time, reason uint8) []flowRecord {
+	state := &f.export
+
+	egressBytes := atomic.LoadUint64(&f.egressBytes)
+	egressPackets := atomic.LoadUint64(&f.egressPackets)
+	ingressBytes := atomic.LoadUint64(&f.ingressBytes)
+	ingressPackets := atomic.LoadUint64(&f.ingressPackets)
+
+	container := net.IP(f.id.RemoteAddress)
+	remote := net.IP(f.id.LocalAddress)
+	start := e.recordStart(f)
+	before := len(records)
+
+	// the packets only tell whether there was any traffic, as a datagram may very well be empty
+	if egressPackets > state.egressPackets {
+		records = append(records, flowRecord{
+			src: container, srcPort: f.id.RemotePort,
+			dst: remote, dstPort: f.id.LocalPort,
+			proto: uint8(f.proto),
+			bytes: egressBytes - state.egressBytes,
+			start: start, end: end,
+			reason: reason,
+		})
+	}
+
+	if ingressPackets > state.ingressPackets {
+		records = append(records, flowRecord{
+			src: remote, srcPort: f.id.LocalPort,
+			dst: container, dstPort: f.id.RemotePort,
+			proto: uint8(f.proto),
+			bytes: ingressBytes - state.ingressBytes,
+			start: start, end: end,
+			reason: reason,
+		})
+	}
+
+	// a flow without any traffic, like a tcp connection that is closed right away, still gets a record when it ends
+	exported := state.exported || len(records) > before
+	if !exported && reason == flowEndOfFlow {
+		records = append(records, flowRecord{
+			src: container, srcPort: f.id.RemotePort,
+			dst: remote, dstPort: f.id.LocalPort,
+			proto: uint8(f.proto),
+			start: start, end: end,
+			reason: reason,
+		})
+		exported = true
+	}
+
+	*state = flowExportState{
+		recordStart:    end,
+		egressBytes:    egressBytes,
+		egressPackets:  egressPackets,
+		ingressBytes:   ingressBytes,
+		ingressPackets: ingressPackets,
+		exported:       exported,
+	}
+
+	return records
+}
+
+// encode packs the records into as many messages as needed, each message starts with the templates
+// as collectors may very well have missed our previous messages
+func (e *flowExporter) encode(now time.Time, records []flowRecord) [][]byte {
+	var out [][]byte
+
+	for len(records) > 0 {
+		msg := make([]byte, ipfixHeaderSize, ipfixMaxMessageSize)
+		msg = appendTemplateSet(msg)
+
+		var set []byte
+		var setTemplate uint16
+		count := 0
+
+		for len(records) > 0 {
+			record := &records[0]
+			template := record.template()
+			if template != setTemplate {
+				msg = appendDataSet(msg, setTemplate, set)
+				set, setTemplate = nil, template
+			}
+
+			if len(msg)+len(set)+ipfixSetHeaderSize+ipfixRecordLength(template) > ipfixMaxMessageSize {
+				break
+			}
+
+			set = appendRecord(set, record)
+			records = records[1:]
+			count++
+		}
+		msg = appendDataSet(msg, setTemplate, set)
+
+		binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[8:], e.sequence)
+		binary.BigEndian.PutUint32(msg[12:], e.opts.ObservationDomain)
+
+		// the sequence number is the amount of data records sent before this message
+		e.sequence += uint32(count)
+
+		out = append(out, msg)
+	}
+
+	return out
+}
+
+func appendTemplateSet(msg []byte) []byte {
+	start := len(msg)
+	msg = append(msg, 0, 0, 0, 0)
+	for _, id := range []uint16{ipfixTemplateIPv4, ipfixTemplateIPv6} {
+		fields := ipfixTemplates[id]
+		msg = appendUint16(msg, id)
+		msg = appendUint16(msg, uint16(len(fields)))
+		for _, field := range fields {
+			msg = appendUint16(msg, field.id)
+			msg = appendUint16(msg, field.length)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[start:], ipfixTemplateSetID)
+	binary.BigEndian.PutUint16(msg[start+2:], uint16(len(msg)-start))
+	return msg
+}
+
+func appendDataSet(msg []byte, template uint16, set []byte) []byte {
+	if len(set) == 0 {
+		return msg
+	}
+	msg = appendUint16(msg, template)
+	msg = appendUint16(msg, uint16(len(set)+ipfixSetHeaderSize))
+	return append(msg, set...)
+}
+
+func appendRecord(set []byte, r *flowRecord) []byte {
+	if r.template() == ipfixTemplateIPv4 {
+		set = append(set, r.src.To4()...)
+		set = append(set, r.dst.To4()...)
+	} else {
+		set = append(set, r.src.To16()...)
+		set = append(set, r.dst.To16()...)
+	}
+	set = appendUint16(set, r.srcPort)
+	set = appendUint16(set, r.dstPort)
+	set = append(set, r.proto)
+	set = appendUint64(set, r.bytes)
+	set = appendUint64(set, uint64(r.start.UnixNano()/int64(time.Millisecond)))
+	set = appendUint64(set, uint64(r.end.UnixNano()/int64(time.Millisecond)))
+	return append(set, r.reason)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
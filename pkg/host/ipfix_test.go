@@ -0,0 +1,168 @@
+package host
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+type ipfixTestRecord struct {
+	template         uint16
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	proto            uint8
+	bytes            uint64
+	reason           uint8
+}
+
+func decodeIpfix(t *testing.T, msg []byte) []ipfixTestRecord {
+	require.GreaterOrEqual(t, len(msg), ipfixHeaderSize)
+	assert.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(msg[0:]))
+	assert.Equal(t, uint16(len(msg)), binary.BigEndian.Uint16(msg[2:]))
+
+	var out []ipfixTestRecord
+	msg = msg[ipfixHeaderSize:]
+	for len(msg) > 0 {
+		id := binary.BigEndian.Uint16(msg[0:])
+		length := int(binary.BigEndian.Uint16(msg[2:]))
+		set := msg[ipfixSetHeaderSize:length]
+		msg = msg[length:]
+
+		if id == ipfixTemplateSetID {
+			continue
+		}
+
+		addrLen := 4
+		if id == ipfixTemplateIPv6 {
+			addrLen = 16
+		}
+		for len(set) > 0 {
+			r := ipfixTestRecord{template: id}
+			r.src, set = net.IP(set[:addrLen]), set[addrLen:]
+			r.dst, set = net.IP(set[:addrLen]), set[addrLen:]
+			r.srcPort = binary.BigEndian.Uint16(set[0:])
+			r.dstPort = binary.BigEndian.Uint16(set[2:])
+			r.proto = set[4]
+			r.bytes = binary.BigEndian.Uint64(set[5:])
+			r.reason = set[29]
+			set = set[30:]
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func TestFlowExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+
+	flows := newFlowTable()
+	exporter, err := newFlowExporter(flows, FlowExportOptions{
+		Collector:     collector.LocalAddr().String(),
+		ActiveTimeout: time.Minute,
+		IdleTimeout:   time.Minute,
+	})
+	require.NoError(t, err)
+
+	f := newFlow(tcp.ProtocolNumber, stack.TransportEndpointID{
+		LocalAddress:  tcpip.Address(net.IPv4(1, 1, 1, 1).To4()),
+		LocalPort:     80,
+		RemoteAddress: tcpip.Address(net.IPv4(10, 0, 0, 1).To4()),
+		RemotePort:    12345,
+	})
+	flows.add(f)
+	f.addEgress(100)
+	f.addEgress(50)
+	f.addIngress(1000)
+	flows.remove(f)
+
+	// closing the exporter flushes the ended flows
+	require.NoError(t, exporter.Close())
+
+	buf := make([]byte, ipfixMaxMessageSize)
+	_ = collector.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := collector.ReadFrom(buf)
+	require.NoError(t, err)
+
+	records := decodeIpfix(t, buf[:n])
+	require.Len(t, records, 2)
+
+	assert.Equal(t, ipfixTestRecord{
+		template: ipfixTemplateIPv4,
+		src:      net.IPv4(10, 0, 0, 1).To4(), srcPort: 12345,
+		dst: net.IPv4(1, 1, 1, 1).To4(), dstPort: 80,
+		proto:  uint8(tcp.ProtocolNumber),
+		bytes:  150,
+		reason: flowEndOfFlow,
+	}, records[0])
+
+	assert.Equal(t, ipfixTestRecord{
+		template: ipfixTemplateIPv4,
+		src:      net.IPv4(1, 1, 1, 1).To4(), srcPort: 80,
+		dst: net.IPv4(10, 0, 0, 1).To4(), dstPort: 12345,
+		proto:  uint8(tcp.ProtocolNumber),
+		bytes:  1000,
+		reason: flowEndOfFlow,
+	}, records[1])
+}
+
+func TestFlowExportWithoutTraffic(t *testing.T) {
+	e := &flowExporter{}
+	id := stack.TransportEndpointID{
+		LocalAddress:  tcpip.Address(net.IPv4(1, 1, 1, 1).To4()),
+		LocalPort:     80,
+		RemoteAddress: tcpip.Address(net.IPv4(10, 0, 0, 1).To4()),
+		RemotePort:    12345,
+	}
+
+	// a connection that is closed right away only gets a record once it ends
+	f := newFlow(tcp.ProtocolNumber, id)
+	assert.Empty(t, e.collect(nil, f, time.Now(), flowEndIdleTimeout))
+	records := e.collect(nil, f, time.Now(), flowEndOfFlow)
+	require.Len(t, records, 1)
+	assert.Equal(t, net.IP(id.RemoteAddress), records[0].src)
+	assert.Equal(t, uint64(0), records[0].bytes)
+	assert.Equal(t, uint8(flowEndOfFlow), records[0].reason)
+
+	// but a flow that was already exported doesn't get an empty record on top
+	f = newFlow(tcp.ProtocolNumber, id)
+	f.addEgress(10)
+	assert.Len(t, e.collect(nil, f, time.Now(), flowEndActiveTimeout), 1)
+	assert.Empty(t, e.collect(nil, f, time.Now(), flowEndOfFlow))
+}
+
+func TestFlowExportSplitsMessages(t *testing.T) {
+	e := &flowExporter{}
+
+	records := make([]flowRecord, 100)
+	for i := range records {
+		records[i] = flowRecord{
+			src:   net.IPv4(10, 0, 0, 1),
+			dst:   net.IPv4(1, 1, 1, 1),
+			bytes: uint64(i),
+		}
+		if i%2 == 0 {
+			records[i].src = net.ParseIP("2001:db8::2")
+			records[i].dst = net.ParseIP("2001:db8::1")
+		}
+	}
+
+	msgs := e.encode(time.Now(), records)
+	assert.Greater(t, len(msgs), 1)
+
+	total := 0
+	for _, msg := range msgs {
+		assert.LessOrEqual(t, len(msg), ipfixMaxMessageSize)
+		total += len(decodeIpfix(t, msg))
+	}
+	assert.Equal(t, len(records), total)
+	assert.Equal(t, uint32(len(records)), e.sequence)
+}
@@ -0,0 +1,86 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrContainerExited is reported once the command passed to Wait has exited
+	ErrContainerExited = errors.New("container exited")
+	// ErrBridgeClosed is reported by an Attachment when the container end of its bridge was closed
+	ErrBridgeClosed = errors.New("bridge closed")
+	// ErrDeviceClosed is reported when the device was stopped using Close or Shutdown
+	ErrDeviceClosed = errors.New("device closed")
+)
+
+// lifecycle keeps track of why the device stopped, only the first reason is kept
+type lifecycle struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newLifecycle() lifecycle {
+	return lifecycle{done: make(chan struct{})}
+}
+
+func (l *lifecycle) stop(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+// Done returns a channel that is closed once the networking stopped, see Err for the reason
+func (t *TunDevice) Done() <-chan struct{} {
+	return t.lifecycle.done
+}
+
+// Err returns nil while the device is running, afterwards it returns why it stopped.
+// This is one of ErrContainerExited, ErrDeviceClosed or the error of the context passed to Run, use errors.Is
+// to check for these. A container process that goes away only stops its Attachment, see Current, so the device
+// is ready for the next NewAttachment.
+func (t *TunDevice) Err() error {
+	select {
+	case <-t.lifecycle.done:
+		return t.lifecycle.err
+	default:
+		return nil
+	}
+}
+
+// Run blocks until either ctx is done or the networking stopped for another reason, after which it closes
+// the device. The returned error is the reason it stopped, see Err.
+func (t *TunDevice) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		t.lifecycle.stop(ctx.Err())
+	case <-t.Done():
+	}
+
+	if err := t.Close(); err != nil {
+		logrus.Warnf("Error while closing the device: %s", err)
+	}
+	return t.Err()
+}
+
+// Wait waits for cmd to exit, after which the device reports ErrContainerExited.
+// The returned error is the one from cmd.Wait.
+func (t *TunDevice) Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	t.lifecycle.stop(containerExited(err))
+	return err
+}
+
+func containerExited(err error) error {
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrContainerExited, err)
+	}
+	return ErrContainerExited
+}
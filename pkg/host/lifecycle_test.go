@@ -0,0 +1,118 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitDone(t *testing.T, tun *TunDevice) {
+	select {
+	case <-tun.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("device didn't stop")
+	}
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	assert.NoError(t, tun.Err())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+
+	assert.ErrorIs(t, tun.Run(ctx), context.Canceled)
+	waitDone(t, tun)
+	assert.ErrorIs(t, tun.Err(), context.Canceled)
+}
+
+func waitAttachmentDone(t *testing.T, a *Attachment) {
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("attachment didn't stop")
+	}
+}
+
+func TestBridgeClosed(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	// without a process holding on to the other end the bridge closes straight away
+	a := tun.Current()
+	require.NoError(t, tun.Started())
+
+	waitAttachmentDone(t, a)
+	assert.ErrorIs(t, a.Err(), ErrBridgeClosed)
+	assert.NoError(t, tun.Err(), "only the attachment stops")
+}
+
+func TestBridgeClosedProcessExited(t *testing.T) {
+	path, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	a := tun.Current()
+	cmd := exec.Command(path, "0.2")
+	tun.AttachToCmd(cmd)
+	require.NoError(t, cmd.Start())
+	require.NoError(t, tun.Started())
+
+	// the process holds the only copy of the other end now
+	assert.NoError(t, a.Err())
+	require.NoError(t, cmd.Wait())
+
+	waitAttachmentDone(t, a)
+	assert.ErrorIs(t, a.Err(), ErrBridgeClosed)
+	assert.NoError(t, tun.Err())
+}
+
+func TestDeviceClosed(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, tun.Close())
+	waitDone(t, tun)
+	assert.ErrorIs(t, tun.Err(), ErrDeviceClosed)
+}
+
+func TestWaitContainerExited(t *testing.T) {
+	for _, name := range []string{"true", "false"} {
+		t.Run(name, func(t *testing.T) {
+			path, err := exec.LookPath(name)
+			if err != nil {
+				t.Skip(err)
+			}
+
+			tun, err := New(DefaultOptions())
+			require.NoError(t, err)
+			defer tun.Close()
+
+			cmd := exec.Command(path)
+			tun.AttachToCmd(cmd)
+			require.NoError(t, cmd.Start())
+
+			err = tun.Wait(cmd)
+			var exitErr *exec.ExitError
+			assert.Equal(t, name == "false", errors.As(err, &exitErr))
+
+			waitDone(t, tun)
+			assert.ErrorIs(t, tun.Err(), ErrContainerExited)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+var (
+	errNoBackends        = errors.New("service has no backends")
+	errNoHealthyBackends = errors.New("none of the backends of the service are healthy")
+)
+
+type LBStrategy int
+
+const (
+	// LBRoundRobin spreads the connections over the backends in turn
+	LBRoundRobin LBStrategy = iota
+	// LBLeastConns picks the backend with the fewest active connections
+	LBLeastConns
+)
+
+// Service is a virtual ip:port inside the container network, of which the TCP connections are spread over
+// several backends. When dialing a backend fails the next one is tried, before the container sees a failure.
+type Service struct {
+	// VIP is the ip:port the container connects to
+	VIP      string
+	Backends []string
+	Strategy LBStrategy
+
+	// HealthCheckInterval is how often the backends are checked by connecting to them through their egress,
+	// 0 disables the checks. Backends that fail their check are skipped until they pass again.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout defaults to a second
+	HealthCheckTimeout time.Duration
+}
+
+type backend struct {
+	addr    string
+	healthy uint32
+	conns   int32
+}
+
+func (b *backend) isHealthy() bool {
+	return atomic.LoadUint32(&b.healthy) == 1
+}
+
+type service struct {
+	opts     Service
+	key      virtualKey
+	backends []*backend
+	next     uint32
+
+	// cancel stops the health checks, they are stopped on Shutdown as well
+	cancel context.CancelFunc
+}
+
+// services are the load balanced services by their VIP
+type services struct {
+	mutex sync.RWMutex
+	byVIP map[virtualKey]*service
+}
+
+// AddService starts load balancing the connections to the VIP of svc, replacing an earlier service with the same VIP
+func (t *TunDevice) AddService(svc Service) error {
+	if len(svc.Backends) == 0 {
+		return errNoBackends
+	}
+	_, key, err := parseVirtualAddr("tcp", svc.VIP)
+	if err != nil {
+		return err
+	}
+	for _, addr := range svc.Backends {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid backend %s: %w", addr, err)
+		}
+	}
+	if svc.HealthCheckTimeout <= 0 {
+		svc.HealthCheckTimeout = time.Second
+	}
+
+	s := &service{opts: svc, key: key}
+	for _, addr := range svc.Backends {
+		s.backends = append(s.backends, &backend{addr: addr, healthy: 1})
+	}
+
+	t.services.mutex.Lock()
+	defer t.services.mutex.Unlock()
+
+	// checked while holding the lock, so Shutdown is guaranteed to stop the health checks
+	if err := t.Err(); err != nil {
+		return err
+	}
+	if err := t.claimVirtual(key.addr); err != nil {
+		return err
+	}
+	if previous, ok := t.services.byVIP[key]; ok {
+		previous.cancel()
+		t.releaseVirtual(key.addr)
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(t.ctx)
+	t.services.byVIP[key] = s
+
+	if svc.HealthCheckInterval > 0 {
+		t.wg.Add(1)
+		go t.healthCheck(ctx, s)
+	}
+	return nil
+}
+
+// RemoveService stops load balancing the VIP, existing connections are left alone
+func (t *TunDevice) RemoveService(vip string) error {
+	_, key, err := parseVirtualAddr("tcp", vip)
+	if err != nil {
+		return err
+	}
+
+	t.services.mutex.Lock()
+	defer t.services.mutex.Unlock()
+
+	s, ok := t.services.byVIP[key]
+	if !ok {
+		return fmt.Errorf("there is no service at %s", vip)
+	}
+	s.cancel()
+	delete(t.services.byVIP, key)
+	t.releaseVirtual(key.addr)
+	return nil
+}
+
+// ServiceHealth returns whether each of the backends of the service at vip is healthy
+func (t *TunDevice) ServiceHealth(vip string) map[string]bool {
+	_, key, err := parseVirtualAddr("tcp", vip)
+	if err != nil {
+		return nil
+	}
+
+	t.services.mutex.RLock()
+	s, ok := t.services.byVIP[key]
+	t.services.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	out := make(map[string]bool, len(s.backends))
+	for _, b := range s.backends {
+		out[b.addr] = b.isHealthy()
+	}
+	return out
+}
+
+func (t *TunDevice) service(addr tcpip.Address, port uint16) *service {
+	t.services.mutex.RLock()
+	defer t.services.mutex.RUnlock()
+	return t.services.byVIP[virtualKey{network: "tcp", addr: addr, port: port}]
+}
+
+func (t *TunDevice) healthCheck(ctx context.Context, s *service) {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(s.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range s.backends {
+			conn, err := t.checkBackend(ctx, s, b)
+			if err == nil {
+				conn.Close()
+				if atomic.SwapUint32(&b.healthy, 1) == 0 {
+					logrus.Infof("Backend %s of %s is healthy again", b.addr, s.opts.VIP)
+				}
+			} else if ctx.Err() == nil && atomic.SwapUint32(&b.healthy, 0) == 1 {
+				logrus.Warnf("Backend %s of %s failed its health check: %s", b.addr, s.opts.VIP, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackend connects to b through the same egress the connections of the containers take
+func (t *TunDevice) checkBackend(ctx context.Context, s *service, b *backend) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.HealthCheckTimeout)
+	defer cancel()
+	return t.egress.route(b.addr).dial(ctx, "tcp", b.addr)
+}
+
+// candidates returns the healthy backends in the order they should be tried
+func (s *service) candidates() []*backend {
+	n := len(s.backends)
+	ordered := make([]*backend, 0, n)
+
+	switch s.opts.Strategy {
+	case LBLeastConns:
+		ordered = append(ordered, s.backends...)
+		// insertion sort, there are only a few backends
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && atomic.LoadInt32(&ordered[j].conns) < atomic.LoadInt32(&ordered[j-1].conns); j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+	default:
+		start := int(atomic.AddUint32(&s.next, 1)-1) % n
+		for i := 0; i < n; i++ {
+			ordered = append(ordered, s.backends[(start+i)%n])
+		}
+	}
+
+	out := make([]*backend, 0, n)
+	for _, b := range ordered {
+		if b.isHealthy() {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// dial connects to one of the backends, the returned func has to be called once the connection is done
+func (s *service) dial(ctx context.Context, t *TunDevice, f *flow) (net.Conn, string, func(), error) {
+	candidates := s.candidates()
+	if len(candidates) == 0 {
+		return nil, "", nil, errNoHealthyBackends
+	}
+
+	var errs error
+	for _, b := range candidates {
+		conn, err := t.dialEgress(ctx, f, "tcp", b.addr)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+
+		atomic.AddInt32(&b.conns, 1)
+		return conn, b.addr, func() { atomic.AddInt32(&b.conns, -1) }, nil
+	}
+	return nil, "", nil, errs
+}
@@ -0,0 +1,198 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// nameHostListener starts a backend on the host loopback which greets every connection with name,
+// the connection is closed once the other side sends anything
+func nameHostListener(t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte(name))
+				_, _ = conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// closedPort returns an address that nothing listens on
+func closedPort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func greeting(t *testing.T, c *testContainer, addr string) (string, net.Conn) {
+	conn, err := c.DialTCP(t, addr)
+	require.NoError(t, err)
+
+	buf := make([]byte, 1)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	return string(buf), conn
+}
+
+func TestServiceRoundRobin(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Services = []Service{{
+		VIP:      "10.0.0.50:80",
+		Backends: []string{nameHostListener(t, "a"), closedPort(t), nameHostListener(t, "b")},
+	}}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	// the closed backend is skipped over, without the container noticing
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		name, conn := greeting(t, container, "10.0.0.50:80")
+		conn.Close()
+		seen[name]++
+	}
+	assert.Len(t, seen, 2)
+	assert.Equal(t, 6, seen["a"]+seen["b"])
+
+	require.NoError(t, tun.RemoveService("10.0.0.50:80"))
+	assert.Nil(t, tun.ServiceHealth("10.0.0.50:80"))
+	assert.Error(t, tun.AddService(Service{VIP: "10.0.0.50:80"}))
+}
+
+func TestServiceLeastConns(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	require.NoError(t, tun.AddService(Service{
+		VIP:      "10.0.0.50:80",
+		Backends: []string{nameHostListener(t, "a"), nameHostListener(t, "b")},
+		Strategy: LBLeastConns,
+	}))
+	container := newTestContainer(t, tun)
+
+	svc := tun.service(tcpip.Address(net.IPv4(10, 0, 0, 50).To4()), 80)
+	active := func() int32 {
+		return atomic.LoadInt32(&svc.backends[0].conns) + atomic.LoadInt32(&svc.backends[1].conns)
+	}
+
+	first, conn := greeting(t, container, "10.0.0.50:80")
+	defer conn.Close()
+
+	// as long as the first connection is open, the other backend gets the new ones
+	for i := 0; i < 3; i++ {
+		name, conn := greeting(t, container, "10.0.0.50:80")
+		assert.NotEqual(t, first, name)
+		_, _ = conn.Write([]byte("bye"))
+		conn.Close()
+		// give the relay a moment to notice the close
+		assert.Eventually(t, func() bool { return active() == 1 }, time.Second*5, time.Millisecond*10)
+	}
+}
+
+func TestServiceHealthCheck(t *testing.T) {
+	healthy := nameHostListener(t, "a")
+	broken := closedPort(t)
+
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	require.NoError(t, tun.AddService(Service{
+		VIP:                 "10.0.0.50:80",
+		Backends:            []string{broken, healthy},
+		HealthCheckInterval: time.Millisecond * 20,
+	}))
+
+	assert.Eventually(t, func() bool {
+		return !tun.ServiceHealth("10.0.0.50:80")[broken]
+	}, time.Second*5, time.Millisecond*10)
+	assert.True(t, tun.ServiceHealth("10.0.0.50:80")[healthy])
+
+	// the broken backend isn't even tried anymore
+	container := newTestContainer(t, tun)
+	for i := 0; i < 2; i++ {
+		name, conn := greeting(t, container, "10.0.0.50:80")
+		conn.Close()
+		assert.Equal(t, "a", name)
+	}
+	assert.Zero(t, tun.Snapshot().Drops.DialFailed)
+}
+
+func TestServiceHealthCheckEgress(t *testing.T) {
+	healthy := nameHostListener(t, "a")
+
+	// the backend is only reachable through the egress, which is where the health checks have to go as well
+	var dials int32
+	opts := DefaultOptions()
+	opts.Egress = EgressOptions{
+		Dialers: map[string]EgressDialer{"proxy": func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, healthy)
+		}},
+		Routes: []EgressRoute{{CIDR: mustCIDR(t, "198.51.100.0/24"), Egress: "proxy"}},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	broken := closedPort(t)
+	require.NoError(t, tun.AddService(Service{
+		VIP:                 "10.0.0.50:80",
+		Backends:            []string{"198.51.100.1:80", broken},
+		HealthCheckInterval: time.Millisecond * 20,
+	}))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&dials) > 2 && !tun.ServiceHealth("10.0.0.50:80")[broken]
+	}, time.Second*5, time.Millisecond*10)
+	assert.True(t, tun.ServiceHealth("10.0.0.50:80")["198.51.100.1:80"])
+
+	container := newTestContainer(t, tun)
+	name, conn := greeting(t, container, "10.0.0.50:80")
+	conn.Close()
+	assert.Equal(t, "a", name)
+
+	// once no backend is healthy the connections are refused, rather than trying the broken ones anyway
+	require.NoError(t, tun.AddService(Service{
+		VIP:                 "10.0.0.51:80",
+		Backends:            []string{broken},
+		HealthCheckInterval: time.Millisecond * 20,
+	}))
+	assert.Eventually(t, func() bool {
+		return !tun.ServiceHealth("10.0.0.51:80")[broken]
+	}, time.Second*5, time.Millisecond*10)
+	dialFailed := tun.Snapshot().Drops.DialFailed
+	conn, err = container.DialTCP(t, "10.0.0.51:80")
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.Error(t, err)
+	assert.Equal(t, dialFailed+1, tun.Snapshot().Drops.DialFailed)
+}
@@ -0,0 +1,110 @@
+package host
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// MetadataAddress is where the containers can reach the metadata service, just like on most clouds
+var MetadataAddress = net.IPv4(169, 254, 169, 254).To4()
+
+type MetadataOptions struct {
+	// Handler provides the content of the metadata service, it is disabled when nil.
+	// Use MetadataAttachment to find out which container made the request.
+	Handler http.Handler
+}
+
+type metadataContextKey struct{}
+
+// MetadataAttachment returns the attachment that made a request to the metadata service
+func MetadataAttachment(ctx context.Context) *Attachment {
+	a, _ := ctx.Value(metadataContextKey{}).(*Attachment)
+	return a
+}
+
+type metadataNetwork struct {
+	Name     string `json:"name,omitempty"`
+	Address  string `json:"address"`
+	Address6 string `json:"address6,omitempty"`
+	Gateway  string `json:"gateway"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	Segment  string `json:"segment,omitempty"`
+}
+
+// serveMetadata serves the metadata service on a virtual address, so it doesn't need any egress.
+// Besides whatever the handler provides it exposes the network config of the container at /nsnet/network.
+func (t *TunDevice) serveMetadata(opts MetadataOptions) error {
+	listener, err := t.Listen("tcp", net.JoinHostPort(MetadataAddress.String(), "80"))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nsnet/network", t.metadataNetwork)
+	mux.Handle("/", opts.Handler)
+
+	t.metadata = &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, metadataContextKey{}, t.metadataAttachment(conn.RemoteAddr()))
+		},
+	}
+	go func() {
+		if err := t.metadata.Serve(listener); err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			logrus.Errorf("Metadata server stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+// metadataAttachment returns the attachment behind addr, this is always the current one for a device created using New
+func (t *TunDevice) metadataAttachment(addr net.Addr) *Attachment {
+	if t.network == nil {
+		return t.current()
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return t.network.lookup(ipAddress(tcpAddr.IP))
+}
+
+func (t *TunDevice) metadataNetwork(w http.ResponseWriter, r *http.Request) {
+	a := MetadataAttachment(r.Context())
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	out := metadataNetwork{
+		Name:    a.name,
+		Address: "10.0.0.1",
+		Gateway: "10.0.0.1",
+		Segment: a.segment,
+	}
+	if t.network != nil {
+		out.Address = a.Addr().String()
+		out.Gateway = t.network.Gateway().String()
+		if a.addr6 != "" {
+			out.Address6 = a.Addr6().String()
+			out.Gateway6 = t.network.Gateway6().String()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// isMetadataPacket returns whether pkt is for the metadata service, other ports of its address are left alone
+func isMetadataPacket(pkt *stack.PacketBuffer, version int) bool {
+	key, ok := packetConnKey(pkt, version)
+	return ok && key.dst == tcpip.Address(MetadataAddress) && key.proto == header.TCPProtocolNumber && key.dport == 80
+}
@@ -0,0 +1,87 @@
+package host
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// httpClient returns a client that makes its requests from within the container
+func (c *testContainer) httpClient(tb testing.TB) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.DialTCP(tb, addr)
+		},
+	}
+	tb.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetadata(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.Policy.DenyEgress = true
+	opts.Network.Segments = map[string]string{"db": "backend"}
+	opts.Metadata.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := MetadataAttachment(r.Context())
+		if !assert.NotNil(t, a) {
+			return
+		}
+		_, _ = io.WriteString(w, "token for "+a.Name())
+	})
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	db, err := network.NewAttachment("db", nil)
+	require.NoError(t, err)
+	appClient := newAttachedTestContainer(t, app).httpClient(t)
+	dbClient := newAttachedTestContainer(t, db).httpClient(t)
+
+	// every container gets its own answers, even though all egress is denied
+	assert.Equal(t, "token for app", get(t, appClient, "http://169.254.169.254/token"))
+	assert.Equal(t, "token for db", get(t, dbClient, "http://169.254.169.254/token"))
+
+	var config metadataNetwork
+	require.NoError(t, json.Unmarshal([]byte(get(t, dbClient, "http://169.254.169.254/nsnet/network")), &config))
+	assert.Equal(t, metadataNetwork{
+		Name:    "db",
+		Address: db.Addr().String(),
+		Gateway: "10.0.0.1",
+		Segment: "backend",
+	}, config)
+}
+
+func TestMetadataSingleContainer(t *testing.T) {
+	var tun *TunDevice
+	opts := DefaultOptions()
+	opts.Metadata.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, tun.current(), MetadataAttachment(r.Context()))
+		_, _ = io.WriteString(w, "hello")
+	})
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	client := newTestContainer(t, tun).httpClient(t)
+	assert.Equal(t, "hello", get(t, client, "http://169.254.169.254/"))
+	assert.Contains(t, get(t, client, "http://169.254.169.254/nsnet/network"), `"address":"10.0.0.1"`)
+}
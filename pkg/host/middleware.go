@@ -0,0 +1,81 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// FlowInfo describes a forwarded TCP connection
+type FlowInfo struct {
+	// ID is the same id the flow has in the admin endpoint
+	ID uint64
+	// Container is the address of the container end of the connection
+	Container *net.TCPAddr
+	// Destination is the address the container connected to
+	Destination *net.TCPAddr
+	// Upstream is the address that was actually dialed, this differs from Destination if it was rewritten
+	Upstream string
+}
+
+// ConnRelay relays the traffic between the container and the upstream connection, until both sides are done.
+// The ctx carries the span of the connection if tracing is enabled.
+type ConnRelay func(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error
+
+// ConnMiddleware wraps a ConnRelay. A middleware can wrap either connection before passing them on to next,
+// or take over the relay entirely by not calling next at all. Both connections are closed by nsnet once
+// the relay returns, so a middleware doesn't have to take care of that. A wrapped connection should implement
+// CloseWrite, like net.TCPConn does, as the end of one direction is passed on that way.
+type ConnMiddleware func(next ConnRelay) ConnRelay
+
+// copyRelay is the relay at the end of every middleware chain, it simply copies in both directions
+func copyRelay(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error {
+	return bridgeConns(container, upstream)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// bridgeConns copies in both directions until both are done. Once one side is done sending the other side is half
+// closed, so the other direction keeps going until that is done as well. Both are closed straight away when copying
+// fails or a side can't be half closed, as the other direction would otherwise wait for a peer that never hears of it.
+func bridgeConns(a, b net.Conn) error {
+	var closeOnce sync.Once
+	var closeErr error
+	closeBoth := func(err error) {
+		closeOnce.Do(func() {
+			closeErr = err
+			_ = a.Close()
+			_ = b.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+			return
+		}
+		closeBoth(err)
+	}
+
+	go copyHalf(b, a)
+	go copyHalf(a, b)
+	wg.Wait()
+
+	// whatever the other direction ran into after we closed both doesn't matter
+	return closeErr
+}
+
+// chainMiddleware builds the relay out of the middlewares, the first middleware is the outermost one
+func chainMiddleware(middlewares []ConnMiddleware) ConnRelay {
+	relay := ConnRelay(copyRelay)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		relay = middlewares[i](relay)
+	}
+	return relay
+}
@@ -0,0 +1,171 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// upperConn uppercases everything that is written to it
+type upperConn struct {
+	net.Conn
+}
+
+func (c *upperConn) Write(b []byte) (int, error) {
+	return c.Conn.Write(bytes.ToUpper(b))
+}
+
+func TestConnMiddleware(t *testing.T) {
+	var mutex sync.Mutex
+	var order []string
+	var seen *FlowInfo
+
+	record := func(name string) ConnMiddleware {
+		return func(next ConnRelay) ConnRelay {
+			return func(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error {
+				mutex.Lock()
+				order = append(order, name)
+				seen = info
+				mutex.Unlock()
+				return next(ctx, info, container, upstream)
+			}
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.TCPOptions.Middleware = []ConnMiddleware{
+		record("outer"),
+		record("inner"),
+		func(next ConnRelay) ConnRelay {
+			return func(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error {
+				return next(ctx, info, container, &upperConn{upstream})
+			}
+		},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(buf))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"outer", "inner"}, order)
+	assert.Equal(t, "10.0.0.100", seen.Destination.IP.String())
+	assert.Equal(t, "10.0.0.1", seen.Container.IP.String())
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", port), seen.Upstream)
+	assert.Equal(t, port, strconv.Itoa(seen.Destination.Port))
+}
+
+func TestConnMiddlewareTakeover(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.TCPOptions.Middleware = []ConnMiddleware{
+		func(next ConnRelay) ConnRelay {
+			return func(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error {
+				_, err := container.Write([]byte("intercepted"))
+				return err
+			}
+		},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "intercepted", string(data))
+}
+
+func TestCopyRelayHalfClose(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the host only stops echoing once it sees our end, after which we see its end
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*gonet.TCPConn).CloseWrite())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+}
+
+func TestCopyRelayWithoutHalfClose(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.TCPOptions.Middleware = []ConnMiddleware{
+		func(next ConnRelay) ConnRelay {
+			return func(ctx context.Context, info *FlowInfo, container, upstream net.Conn) error {
+				return next(ctx, info, container, &upperConn{upstream})
+			}
+		},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	_, port := hostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the host never answers nor closes, as our end can't be passed on through upperConn the flow is torn down
+	require.NoError(t, conn.(*gonet.TCPConn).CloseWrite())
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second*5)))
+	_, err = io.ReadAll(conn)
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the relay wasn't torn down")
+
+	assert.Eventually(t, func() bool {
+		empty := true
+		tun.flows.Range(func(*flow) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second*5, time.Millisecond*10)
+}
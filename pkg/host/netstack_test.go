@@ -0,0 +1,150 @@
+package host
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/schoentoon/nsnet/pkg/common"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// testContainer stands in for a container in tests that don't need an actual namespace,
+// it runs a netstack of its own on the container end of the bridge
+type testContainer struct {
+	stack *stack.Stack
+}
+
+func newTestContainer(tb testing.TB, tun *TunDevice) *testContainer {
+	return newAttachedTestContainer(tb, tun.current())
+}
+
+func newAttachedTestContainer(tb testing.TB, a *Attachment) *testContainer {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+	})
+	// we use our own copy of the fd, the device closes its copy on Close while our stack may still be using it
+	fd, err := unix.Dup(int(a.containerFd.Fd()))
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		s.Close()
+		s.Wait()
+		unix.Close(fd)
+	})
+
+	ep, err := fdbased.New(&fdbased.Options{
+		FDs: []int{fd},
+		MTU: common.MTU,
+	})
+	require.NoError(tb, err)
+
+	// the containers of a Network have an address of their own
+	addr := a.addr
+	if addr == "" {
+		addr = tcpip.Address(net.IPv4(10, 0, 0, 1).To4())
+	}
+
+	require.Nil(tb, s.CreateNIC(nicID, ep))
+	require.Nil(tb, s.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: addr.WithPrefix(),
+	}, stack.AddressProperties{}))
+	s.AddRoute(tcpip.Route{
+		Destination: header.IPv4EmptySubnet,
+		NIC:         nicID,
+	})
+
+	return &testContainer{stack: s}
+}
+
+func (c *testContainer) fullAddress(tb testing.TB, addr string) tcpip.FullAddress {
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(tb, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(tb, err)
+
+	return tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpip.Address(net.ParseIP(host).To4()),
+		Port: uint16(p),
+	}
+}
+
+func (c *testContainer) DialTCP(tb testing.TB, addr string) (net.Conn, error) {
+	return gonet.DialTCP(c.stack, c.fullAddress(tb, addr), ipv4.ProtocolNumber)
+}
+
+func (c *testContainer) DialUDP(tb testing.TB, addr string) (net.Conn, error) {
+	raddr := c.fullAddress(tb, addr)
+	return gonet.DialUDP(c.stack, nil, &raddr, ipv4.ProtocolNumber)
+}
+
+func (c *testContainer) ListenTCP(tb testing.TB, port uint16) net.Listener {
+	listener, err := gonet.ListenTCP(c.stack, tcpip.FullAddress{NIC: nicID, Port: port}, ipv4.ProtocolNumber)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// Ping sends an ICMP echo request to ip, and returns an error unless the reply arrives in time
+func (c *testContainer) Ping(tb testing.TB, ip string) error {
+	var wq waiter.Queue
+	ep, tcpipErr := c.stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+	require.Nil(tb, tcpipErr)
+	defer ep.Close()
+
+	entry, readable := waiter.NewChannelEntry(waiter.ReadableEvents)
+	wq.EventRegister(&entry)
+	defer wq.EventUnregister(&entry)
+
+	request := make(header.ICMPv4, header.ICMPv4MinimumSize+4)
+	request.SetType(header.ICMPv4Echo)
+	copy(request.Payload(), "ping")
+	to := tcpip.FullAddress{NIC: nicID, Addr: tcpip.Address(net.ParseIP(ip).To4())}
+	if _, tcpipErr := ep.Write(bytes.NewReader(request), tcpip.WriteOptions{To: &to}); tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+
+	select {
+	case <-readable:
+	case <-time.After(time.Millisecond * 200):
+		return errors.New("no reply")
+	}
+
+	var reply bytes.Buffer
+	if _, tcpipErr := ep.Read(&reply, tcpip.ReadOptions{}); tcpipErr != nil {
+		return errors.New(tcpipErr.String())
+	}
+	if header.ICMPv4(reply.Bytes()).Type() != header.ICMPv4EchoReply {
+		return errors.New("not an echo reply")
+	}
+	return nil
+}
+
+// hostListener starts a listener on the host loopback, which the container can reach at 10.0.0.100 on the returned port
+func hostListener(tb testing.TB) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	tb.Cleanup(func() { listener.Close() })
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(tb, err)
+
+	return listener, port
+}
@@ -0,0 +1,322 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/multierr"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var errNetworkAttachment = errors.New("containers on a Network are attached using Network.NewAttachment")
+
+type NetworkOptions struct {
+	// Subnet the addresses of the containers are in, the first address of it is used as the gateway
+	Subnet *net.IPNet
+	// Subnet6 is optional, when set every container gets an IPv6 address from it as well
+	Subnet6 *net.IPNet
+
+	// Reservations are the static addresses of attachments by their name, these are never given to anybody else
+	Reservations map[string][]net.IP
+	// LeaseFile persists the addresses that were handed out, so names get the same addresses after a restart
+	LeaseFile string
+
+	// DNS is the DNS server on the gateway, which resolves the attachments by name.nsnet.internal
+	DNS DNSOptions
+
+	// Segments are the segments of the attachments by their name, attachments that aren't in here are
+	// in the unnamed segment. Policy decides which segments can reach each other.
+	Segments map[string]string
+	Policy   PolicyOptions
+}
+
+// Network is a single host stack shared by multiple containers, every container gets an Attachment
+// with an address of its own. The containers can reach each other directly, and the outside world
+// through the stack the same way a TunDevice created with New does.
+type Network struct {
+	*TunDevice
+
+	ipam     *ipam
+	gateway  tcpip.Address
+	gateway6 tcpip.Address
+
+	dns      *dnsServer
+	segments map[string]string
+	policy   *policy
+
+	mutex   sync.RWMutex
+	nextNIC tcpip.NICID
+	byName  map[string]*Attachment
+	byAddr  map[tcpip.Address]*Attachment
+}
+
+func NewNetwork(opts Options) (*Network, error) {
+	ipam, err := newIPAM(opts.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	tun, err := newDevice(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Network{
+		TunDevice: tun,
+		ipam:      ipam,
+		gateway:   ipAddress(ipam.v4.gateway),
+		segments:  opts.Network.Segments,
+		policy:    newPolicy(opts.Network.Policy),
+		nextNIC:   1,
+		byName:    make(map[string]*Attachment),
+		byAddr:    make(map[tcpip.Address]*Attachment),
+	}
+	if ipam.v6 != nil {
+		out.gateway6 = ipAddress(ipam.v6.gateway)
+	}
+	if !opts.Network.DNS.Disabled {
+		out.dns = newDNSServer(out, opts.Network.DNS)
+	}
+	tun.network = out
+
+	// the containers can't be given the addresses the host aliases and unix sockets answer on
+	for addr := range tun.hostAliases.aliases {
+		if err := ipam.claimVirtual(net.IP(addr)); err != nil {
+			return nil, fmt.Errorf("host alias: %w", err)
+		}
+	}
+	for addr := range tun.tcpHandler.unixSockets {
+		host, _, _ := net.SplitHostPort(addr)
+		if err := ipam.claimVirtual(net.ParseIP(host)); err != nil {
+			return nil, fmt.Errorf("unix socket: %w", err)
+		}
+	}
+
+	if opts.AdminSocket != "" {
+		if err := tun.serveAdmin(opts.AdminSocket); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Metadata.Handler != nil {
+		if err := tun.serveMetadata(opts.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// claimVirtual keeps addr from being assigned to an attachment while a service or virtual listener uses it
+func (t *TunDevice) claimVirtual(addr tcpip.Address) error {
+	if t.network == nil {
+		return nil
+	}
+	return t.network.ipam.claimVirtual(net.IP(addr))
+}
+
+func (t *TunDevice) releaseVirtual(addr tcpip.Address) {
+	if t.network != nil {
+		t.network.ipam.releaseVirtual(net.IP(addr))
+	}
+}
+
+// ipAddress converts ip to a tcpip.Address, using the 4 byte form for IPv4 addresses
+func ipAddress(ip net.IP) tcpip.Address {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.Address(ip4)
+	}
+	return tcpip.Address(ip.To16())
+}
+
+// Gateway returns the address the containers should use as their gateway
+func (n *Network) Gateway() net.IP {
+	return net.IP(n.gateway)
+}
+
+// Gateway6 returns the IPv6 gateway, this is nil if the network has no IPv6 subnet
+func (n *Network) Gateway6() net.IP {
+	if n.gateway6 == "" {
+		return nil
+	}
+	return net.IP(n.gateway6)
+}
+
+// NewAttachment adds a container with the given name to the network, the name has to be unique.
+// When addr is nil an address is assigned, preferring a reservation or previous lease of name.
+// Use AttachToCmd on the returned Attachment to hand it to the container process, this also tells the
+// container its addresses.
+func (n *Network) NewAttachment(name string, addr net.IP) (*Attachment, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// checked while holding the lock, so Shutdown is guaranteed to see our attachment
+	if err := n.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := n.byName[name]; ok {
+		return nil, fmt.Errorf("there already is an attachment named %s", name)
+	}
+
+	v4, v6, err := n.ipam.allocate(name, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &tunEndPoint{tun: n.TunDevice}
+	a, err := newAttachment(n.TunDevice, endpoint)
+	if err != nil {
+		n.ipam.release(v4, v6)
+		return nil, err
+	}
+	a.name = name
+	a.addr = ipAddress(v4)
+	if v6 != nil {
+		a.addr6 = ipAddress(v6)
+	}
+	a.nic = n.nextNIC
+	a.segment = n.segments[name]
+	endpoint.fixed = a
+
+	if err := n.addNIC(a); err != nil {
+		_ = n.stack.RemoveNIC(a.nic)
+		_ = a.detach()
+		n.ipam.release(v4, v6)
+		return nil, err
+	}
+	n.nextNIC++
+
+	n.byName[name] = a
+	n.byAddr[a.addr] = a
+	if a.addr6 != "" {
+		n.byAddr[a.addr6] = a
+	}
+
+	return a, nil
+}
+
+// addNIC creates the NIC of the attachment, with routes for its addresses
+func (n *Network) addNIC(a *Attachment) error {
+	if err := n.createNIC(a.nic, a.endpoint, n.gateway); err != nil {
+		return err
+	}
+
+	addrs := []tcpip.Address{a.addr}
+	if a.addr6 != "" {
+		tcpipErr := n.stack.AddProtocolAddress(a.nic, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: n.gateway6.WithPrefix(),
+		}, stack.AddressProperties{})
+		if tcpipErr != nil {
+			return errors.New(tcpipErr.String())
+		}
+		addrs = append(addrs, a.addr6)
+	}
+
+	for _, addr := range addrs {
+		subnet, err := tcpip.NewSubnet(addr, tcpip.AddressMask(net.IP(allOnes(len(addr)))))
+		if err != nil {
+			return err
+		}
+		n.stack.AddRoute(tcpip.Route{
+			Destination: subnet,
+			NIC:         a.nic,
+		})
+	}
+
+	return nil
+}
+
+func allOnes(n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = 0xff
+	}
+	return out
+}
+
+// Attachment returns the attachment with the given name, or nil if there is none
+func (n *Network) Attachment(name string) *Attachment {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.byName[name]
+}
+
+// attachmentByName is like Attachment, but ignores the case of the name as DNS does
+func (n *Network) attachmentByName(name string) *Attachment {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if a, ok := n.byName[name]; ok {
+		return a
+	}
+	for other, a := range n.byName {
+		if strings.EqualFold(other, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+func (n *Network) attachments() []*Attachment {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	out := make([]*Attachment, 0, len(n.byName))
+	for _, a := range n.byName {
+		out = append(out, a)
+	}
+	return out
+}
+
+// lookup returns the attachment with addr as its address
+func (n *Network) lookup(addr tcpip.Address) *Attachment {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.byAddr[addr]
+}
+
+// remove takes the attachment off the network and resets all of its flows
+func (n *Network) remove(a *Attachment) error {
+	n.mutex.Lock()
+	if n.byName[a.name] != a {
+		n.mutex.Unlock()
+		return a.detach()
+	}
+	delete(n.byName, a.name)
+	delete(n.byAddr, a.addr)
+	delete(n.byAddr, a.addr6)
+	n.mutex.Unlock()
+
+	var v6 net.IP
+	if a.addr6 != "" {
+		v6 = net.IP(a.addr6)
+	}
+	defer n.ipam.release(net.IP(a.addr), v6)
+
+	// closing the bridge stops the dispatchLoop, which must not deliver packets to the NIC once it is gone
+	err := a.detach()
+	a.loop.Wait()
+
+	n.stack.RemoveRoutes(func(r tcpip.Route) bool {
+		return r.NIC == a.nic
+	})
+	if tcpipErr := n.stack.RemoveNIC(a.nic); tcpipErr != nil {
+		return multierr.Append(err, errors.New(tcpipErr.String()))
+	}
+
+	n.policy.forget(a)
+
+	n.flows.Range(func(f *flow) bool {
+		if f.id.RemoteAddress == a.addr || (a.addr6 != "" && f.id.RemoteAddress == a.addr6) {
+			_ = f.Close()
+		}
+		return true
+	})
+
+	return err
+}
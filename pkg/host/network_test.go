@@ -0,0 +1,156 @@
+package host
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestNetwork(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	assert.Equal(t, "10.0.0.1", network.Gateway().String())
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	db, err := network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	assert.Equal(t, db, network.Attachment("db"))
+	assert.Equal(t, "10.0.0.3", db.Addr().String())
+
+	appContainer := newAttachedTestContainer(t, app)
+	dbContainer := newAttachedTestContainer(t, db)
+
+	listener := dbContainer.ListenTCP(t, 5432)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// container to container
+	conn, err := appContainer.DialTCP(t, "10.0.0.3:5432")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "select 1")
+
+	// and the outside is still reachable
+	port := echoHostListener(t)
+	conn, err = appContainer.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	// removing an attachment resets its flows, while the other containers are left alone
+	require.NoError(t, app.Close())
+	assert.ErrorIs(t, app.Err(), ErrDetached)
+	assert.Nil(t, network.Attachment("app"))
+	assert.NoError(t, db.Err())
+	assert.Eventually(t, func() bool {
+		empty := true
+		network.flows.Range(func(*flow) bool {
+			empty = false
+			return false
+		})
+		return empty
+	}, time.Second*5, time.Millisecond*10)
+
+	// after which the address can be used again
+	app, err = network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	appContainer = newAttachedTestContainer(t, app)
+	conn, err = appContainer.DialTCP(t, "10.0.0.3:5432")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "select 2")
+}
+
+func TestNetworkAttachmentErrors(t *testing.T) {
+	network, err := NewNetwork(DefaultOptions())
+	require.NoError(t, err)
+
+	_, err = network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+
+	_, err = network.NewAttachment("app", net.IPv4(10, 0, 0, 3))
+	assert.Error(t, err, "duplicate name")
+	_, err = network.NewAttachment("db", net.IPv4(10, 0, 0, 2))
+	assert.Error(t, err, "duplicate address")
+	_, err = network.NewAttachment("db", net.IPv4(10, 0, 1, 2))
+	assert.Error(t, err, "outside of the subnet")
+	_, err = network.NewAttachment("db", net.IPv4(10, 0, 0, 1))
+	assert.Error(t, err, "gateway")
+
+	_, err = network.TunDevice.NewAttachment()
+	assert.ErrorIs(t, err, errNetworkAttachment)
+
+	require.NoError(t, network.Close())
+	_, err = network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	assert.ErrorIs(t, err, ErrDeviceClosed)
+}
+
+func TestNetworkPacketSize(t *testing.T) {
+	var packets, oversized int32
+
+	// the packets switched between the containers should be exactly as large as the container sent them
+	opts := DefaultOptions()
+	opts.PacketHooks = []PacketHook{
+		PacketHookFunc(func(dir PacketDirection, pkt *stack.PacketBuffer) (PacketVerdict, *stack.PacketBuffer) {
+			data := PacketBytes(pkt)
+			if dir == PacketToContainer && header.IPVersion(data) == header.IPv4Version {
+				atomic.AddInt32(&packets, 1)
+				if len(data) != int(header.IPv4(data).TotalLength()) {
+					atomic.AddInt32(&oversized, 1)
+				}
+			}
+			return PacketAccept, nil
+		}),
+	}
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	db, err := network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+
+	appContainer := newAttachedTestContainer(t, app)
+	dbContainer := newAttachedTestContainer(t, db)
+
+	listener := dbContainer.ListenTCP(t, 5432)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := appContainer.DialTCP(t, "10.0.0.3:5432")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "select 1")
+
+	assert.Greater(t, atomic.LoadInt32(&packets), int32(0))
+	assert.Zero(t, atomic.LoadInt32(&oversized))
+}
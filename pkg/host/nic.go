@@ -1,7 +1,11 @@
 package host
 
 import (
+	"errors"
+	"sync/atomic"
+
 	"github.com/schoentoon/nsnet/pkg/common"
+	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
@@ -10,7 +14,18 @@ import (
 
 // this struct mostly exists to hide the methods implemented for gvisor interfaces from the public API
 type tunEndPoint struct {
-	tun *TunDevice
+	tun        *TunDevice
+	dispatcher stack.NetworkDispatcher
+
+	// fixed is the attachment of an endpoint on a Network, otherwise packets go to the current attachment
+	fixed *Attachment
+}
+
+func (t *tunEndPoint) attachment() *Attachment {
+	if t.fixed != nil {
+		return t.fixed
+	}
+	return t.tun.current()
 }
 
 // MTU is the maximum transmission unit for this endpoint. This is
@@ -47,14 +62,27 @@ func (t *tunEndPoint) Capabilities() stack.LinkEndpointCapabilities {
 // Attach is called with a nil dispatcher when the endpoint's NIC is being
 // removed.
 func (t *tunEndPoint) Attach(dispatcher stack.NetworkDispatcher) {
-	t.tun.dispatcher = dispatcher
-	go t.tun.dispatchLoop()
+	// the NIC gets removed when the stack is closed or when Network.remove takes the attachment off the network,
+	// both detach the attachment and wait for its dispatchLoop to stop before that
+	if dispatcher == nil {
+		return
+	}
+
+	t.tun.attachMutex.Lock()
+	defer t.tun.attachMutex.Unlock()
+	t.dispatcher = dispatcher
+
+	attachment := t.fixed
+	if attachment == nil {
+		attachment = t.tun.attachment
+	}
+	attachment.startDispatchLoop()
 }
 
 // IsAttached returns whether a NetworkDispatcher is attached to the
 // endpoint.
 func (t *tunEndPoint) IsAttached() bool {
-	return t.tun.dispatcher != nil
+	return t.dispatcher != nil
 }
 
 // Wait waits for any worker goroutines owned by the endpoint to stop.
@@ -88,8 +116,35 @@ func (t *tunEndPoint) AddHeader(pkt *stack.PacketBuffer) {
 // should call eth.Encode with header.EthernetFields.SrcAddr set to
 // r.LocalLinkAddress if it is provided.
 func (t *tunEndPoint) WritePacket(pkt *stack.PacketBuffer) tcpip.Error {
-	view := buffer.NewVectorisedView(pkt.Size(), pkt.Views())
-	if _, err := t.tun.bridge.Write(view.ToView()); err != nil {
+	if n := t.tun.network; n != nil {
+		n.policy.trackFromStack(t.fixed, pkt)
+	}
+	return t.attachment().writePacket(pkt)
+}
+
+// writePacket writes pkt to the container, it doesn't take ownership of pkt
+func (a *Attachment) writePacket(pkt *stack.PacketBuffer) tcpip.Error {
+	t := a.tun
+	if len(t.packetHooks) > 0 {
+		hooked := t.runPacketHooks(PacketToContainer, pkt)
+		if hooked == nil {
+			return nil
+		} else if hooked != pkt {
+			// the stack only releases the packet it gave us, so we have to take care of this one ourselves
+			defer hooked.DecRef()
+			pkt = hooked
+		}
+	}
+
+	vv := buffer.NewVectorisedView(pkt.Size(), pkt.Views())
+	view := vv.ToView()
+	t.capture.write(view)
+	if _, err := a.bridge.Write(view); err != nil {
+		atomic.AddUint64(&t.drops.BridgeWriteFailed, 1)
+		// the container end is gone, so there is no point in continuing
+		if errors.Is(err, unix.EPIPE) || errors.Is(err, unix.ECONNRESET) {
+			a.fail(ErrBridgeClosed)
+		}
 		return &tcpip.ErrInvalidEndpointState{}
 	}
 	return nil
@@ -0,0 +1,308 @@
+package host
+
+import (
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// SegmentAny matches every segment in a PolicyRule
+	SegmentAny = "*"
+	// SegmentEgress is the destination of a PolicyRule for the traffic leaving the network
+	SegmentEgress = "egress"
+)
+
+type PolicyAction int
+
+const (
+	PolicyAllow PolicyAction = iota
+	PolicyDeny
+)
+
+// PolicyRule allows or denies the connections from the attachments in segment From to the ones in segment To
+type PolicyRule struct {
+	From   string
+	To     string
+	Action PolicyAction
+}
+
+// PolicyOptions decides which attachments of a Network can reach each other. Attachments in the same segment
+// can always reach each other while different segments can't, unless a rule says otherwise. The first rule
+// that matches wins. Only the side that starts a connection needs to be allowed, the replies are let through.
+type PolicyOptions struct {
+	Rules []PolicyRule
+	// DenyEgress denies all traffic leaving the network, unless a rule allows it for a segment
+	DenyEgress bool
+}
+
+// how long the replies of an allowed connection are let through after its last packet
+const conntrackTimeout = time.Minute * 2
+
+type connKey struct {
+	proto    tcpip.TransportProtocolNumber
+	src, dst tcpip.Address
+	sport    uint16
+	dport    uint16
+}
+
+func (k connKey) reverse() connKey {
+	return connKey{proto: k.proto, src: k.dst, dst: k.src, sport: k.dport, dport: k.sport}
+}
+
+// connEntry is an allowed connection between two attachments, nil being the stack
+type connEntry struct {
+	from, to *Attachment
+	seen     time.Time
+}
+
+// policy enforces PolicyOptions on the packets from the containers, before they are switched or reach the stack
+type policy struct {
+	mutex sync.RWMutex
+	opts  PolicyOptions
+
+	// conns are the connections that were allowed, only their replies between the same attachments are let through
+	connsMutex sync.Mutex
+	conns      map[connKey]connEntry
+	lastPrune  time.Time
+}
+
+func newPolicy(opts PolicyOptions) *policy {
+	return &policy{
+		opts:      opts,
+		conns:     make(map[connKey]connEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (p *policy) set(opts PolicyOptions) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.opts = opts
+}
+
+func (p *policy) get() PolicyOptions {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.opts
+}
+
+// allowedSegments returns whether segment from is allowed to connect to segment to
+func (p *policy) allowedSegments(from, to string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, rule := range p.opts.Rules {
+		if (rule.From == from || rule.From == SegmentAny) && (rule.To == to || rule.To == SegmentAny) {
+			return rule.Action == PolicyAllow
+		}
+	}
+
+	if to == SegmentEgress {
+		return !p.opts.DenyEgress
+	}
+	return from == to
+}
+
+// allowed returns whether the packet from attachment from is allowed to reach attachment to, or the stack when to is nil
+func (p *policy) allowed(from, to *Attachment, pkt *stack.PacketBuffer, version int) bool {
+	segment := SegmentEgress
+	if to != nil {
+		segment = to.segment
+	}
+
+	key, ok := packetConnKey(pkt, version)
+	if !ok {
+		return p.allowedSegments(from.segment, segment)
+	}
+
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+
+	if p.reply(from, to, key) {
+		return true
+	}
+	if !p.allowedSegments(from.segment, segment) {
+		return false
+	}
+	p.track(from, to, key)
+	return true
+}
+
+// trackFromStack lets the replies of to through for a packet the stack sends it, as the host may connect to
+// the containers regardless of the policy
+func (p *policy) trackFromStack(to *Attachment, pkt *stack.PacketBuffer) {
+	key, ok := outboundConnKey(pkt)
+	if !ok {
+		return
+	}
+
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+
+	// the replies to the connections of the container itself are already tracked
+	if !p.reply(nil, to, key) {
+		p.track(nil, to, key)
+	}
+}
+
+// reply returns whether key is a reply to a connection that was allowed from to to from, this requires connsMutex
+func (p *policy) reply(from, to *Attachment, key connKey) bool {
+	now := time.Now()
+	entry, ok := p.conns[key.reverse()]
+	if !ok || entry.from != to || entry.to != from || now.Sub(entry.seen) >= conntrackTimeout {
+		return false
+	}
+	entry.seen = now
+	p.conns[key.reverse()] = entry
+	return true
+}
+
+// track remembers the connection of key from from to to, this requires connsMutex
+func (p *policy) track(from, to *Attachment, key connKey) {
+	now := time.Now()
+	p.conns[key] = connEntry{from: from, to: to, seen: now}
+	if now.Sub(p.lastPrune) > conntrackTimeout {
+		for k, entry := range p.conns {
+			if now.Sub(entry.seen) >= conntrackTimeout {
+				delete(p.conns, k)
+			}
+		}
+		p.lastPrune = now
+	}
+}
+
+// forget drops the tracked connections of a, once it is taken off the network
+func (p *policy) forget(a *Attachment) {
+	p.connsMutex.Lock()
+	defer p.connsMutex.Unlock()
+
+	for k, entry := range p.conns {
+		if entry.from == a || entry.to == a {
+			delete(p.conns, k)
+		}
+	}
+}
+
+func packetConnKey(pkt *stack.PacketBuffer, version int) (connKey, bool) {
+	var key connKey
+	var transport []byte
+
+	switch version {
+	case header.IPv4Version:
+		v, ok := pkt.Data().PullUp(header.IPv4MinimumSize)
+		if !ok {
+			return key, false
+		}
+		ip := header.IPv4(v)
+		hlen := int(ip.HeaderLength())
+		if hlen < header.IPv4MinimumSize {
+			return key, false
+		}
+		key.proto, key.src, key.dst = ip.TransportProtocol(), ip.SourceAddress(), ip.DestinationAddress()
+		if v, ok := pkt.Data().PullUp(hlen + 4); ok {
+			transport = v[hlen:]
+		}
+	case header.IPv6Version:
+		v, ok := pkt.Data().PullUp(header.IPv6MinimumSize)
+		if !ok {
+			return key, false
+		}
+		ip := header.IPv6(v)
+		key.proto, key.src, key.dst = ip.TransportProtocol(), ip.SourceAddress(), ip.DestinationAddress()
+		if v, ok := pkt.Data().PullUp(header.IPv6MinimumSize + 4); ok {
+			transport = v[header.IPv6MinimumSize:]
+		}
+	default:
+		return key, false
+	}
+
+	// both tcp and udp start with the ports, for anything else the addresses have to do
+	if transport != nil && (key.proto == header.TCPProtocolNumber || key.proto == header.UDPProtocolNumber) {
+		key.sport = uint16(transport[0])<<8 | uint16(transport[1])
+		key.dport = uint16(transport[2])<<8 | uint16(transport[3])
+	}
+	return key, true
+}
+
+// outboundConnKey is packetConnKey for the packets of the stack, these keep their headers apart from the data
+func outboundConnKey(pkt *stack.PacketBuffer) (connKey, bool) {
+	var key connKey
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber, header.IPv6ProtocolNumber:
+	default:
+		return key, false
+	}
+	if pkt.NetworkHeader().View().IsEmpty() {
+		return key, false
+	}
+
+	ip := pkt.Network()
+	key.proto, key.src, key.dst = ip.TransportProtocol(), ip.SourceAddress(), ip.DestinationAddress()
+	if transport := pkt.TransportHeader().View(); len(transport) >= 4 && (key.proto == header.TCPProtocolNumber || key.proto == header.UDPProtocolNumber) {
+		key.sport = uint16(transport[0])<<8 | uint16(transport[1])
+		key.dport = uint16(transport[2])<<8 | uint16(transport[3])
+	}
+	return key, true
+}
+
+// Segment returns the segment of the attachment, see PolicyOptions
+func (a *Attachment) Segment() string {
+	return a.segment
+}
+
+// SetPolicy replaces the policy of the network, connections that were already allowed are left alone
+func (n *Network) SetPolicy(opts PolicyOptions) {
+	n.policy.set(opts)
+}
+
+// Policy returns the current policy of the network
+func (n *Network) Policy() PolicyOptions {
+	return n.policy.get()
+}
+
+// allowed returns whether the packet from a can be switched to target, or enter the stack when target is nil
+func (n *Network) allowed(a *Attachment, target *Attachment, pkt *stack.PacketBuffer, version int) bool {
+	if target != nil {
+		return n.policy.allowed(a, target, pkt, version)
+	}
+
+	// DNS on the gateway, which we answer ourselves, and the metadata service are always reachable
+	if n.dns != nil && isGatewayDNSPacket(n, pkt, version) {
+		return true
+	}
+	if n.metadata != nil && isMetadataPacket(pkt, version) {
+		return true
+	}
+	return n.policy.allowed(a, nil, pkt, version)
+}
+
+func isGatewayDNSPacket(n *Network, pkt *stack.PacketBuffer, version int) bool {
+	key, ok := packetConnKey(pkt, version)
+	if !ok || key.dport != 53 || (key.proto != header.TCPProtocolNumber && key.proto != header.UDPProtocolNumber) {
+		return false
+	}
+	return key.dst == n.gateway || (n.gateway6 != "" && key.dst == n.gateway6)
+}
+
+// spoofed returns whether the packet from a was sent from an address other than its own
+func (a *Attachment) spoofed(pkt *stack.PacketBuffer, version int) bool {
+	var src tcpip.Address
+	switch version {
+	case header.IPv4Version:
+		if v, ok := pkt.Data().PullUp(header.IPv4MinimumSize); ok {
+			src = header.IPv4(v).SourceAddress()
+		}
+	case header.IPv6Version:
+		if v, ok := pkt.Data().PullUp(header.IPv6MinimumSize); ok {
+			src = header.IPv6(v).SourceAddress()
+		}
+	default:
+		// these are dropped later on anyway
+		return false
+	}
+	return src != a.addr && (a.addr6 == "" || src != a.addr6)
+}
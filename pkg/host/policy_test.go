@@ -0,0 +1,243 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func echoContainerListener(t *testing.T, c *testContainer, port uint16) {
+	listener := c.ListenTCP(t, port)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+// unreachable asserts a connection from c to addr can't be made
+func unreachable(t *testing.T, c *testContainer, addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, c.stack, c.fullAddress(t, addr), ipv4.ProtocolNumber)
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err, addr)
+}
+
+func TestPolicySegments(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.Segments = map[string]string{
+		"app":   "frontend",
+		"web":   "frontend",
+		"db":    "backend",
+		"other": "sandbox",
+	}
+	opts.Network.Policy.Rules = []PolicyRule{
+		{From: "frontend", To: "backend", Action: PolicyAllow},
+	}
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	containers := map[string]*testContainer{}
+	for i, name := range []string{"app", "web", "db", "other"} {
+		a, err := network.NewAttachment(name, net.IPv4(10, 0, 0, byte(i+2)))
+		require.NoError(t, err)
+		containers[name] = newAttachedTestContainer(t, a)
+		echoContainerListener(t, containers[name], 80)
+	}
+	assert.Equal(t, "backend", network.Attachment("db").Segment())
+
+	// the same segment, and allowed by a rule
+	conn, err := containers["app"].DialTCP(t, "10.0.0.3:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "web")
+	conn, err = containers["app"].DialTCP(t, "10.0.0.4:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "db")
+
+	// but not the other way around, nor from another segment
+	unreachable(t, containers["db"], "10.0.0.2:80")
+	unreachable(t, containers["other"], "10.0.0.4:80")
+	unreachable(t, containers["app"], "10.0.0.5:80")
+	assert.NotZero(t, network.Snapshot().Drops.Policy)
+
+	// the policy can be changed at runtime
+	network.SetPolicy(PolicyOptions{Rules: []PolicyRule{
+		{From: SegmentAny, To: "backend", Action: PolicyAllow},
+	}})
+	conn, err = containers["other"].DialTCP(t, "10.0.0.4:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "db")
+}
+
+func TestPolicyEgress(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.Network.Segments = map[string]string{"app": "frontend"}
+	opts.Network.Policy = PolicyOptions{
+		DenyEgress: true,
+		Rules: []PolicyRule{
+			{From: "frontend", To: SegmentEgress, Action: PolicyAllow},
+		},
+	}
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	db, err := network.NewAttachment("db", nil)
+	require.NoError(t, err)
+	appContainer := newAttachedTestContainer(t, app)
+	dbContainer := newAttachedTestContainer(t, db)
+
+	port := echoHostListener(t)
+	conn, err := appContainer.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	unreachable(t, dbContainer, net.JoinHostPort("10.0.0.100", port))
+}
+
+func TestPolicyGateway(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Network.DNS.Upstream = "127.0.0.1:1"
+	opts.Network.Policy.DenyEgress = true
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	container := newAttachedTestContainer(t, app)
+	echoContainerListener(t, container, 80)
+
+	// DNS on the gateway is answered by us, anything else on the gateway is egress
+	conn, err := container.DialUDP(t, "10.0.0.1:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	rcode, ips := resolve(t, conn, "app.nsnet.internal.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, rcode)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 2).To4()}, ips)
+
+	unreachable(t, container, "10.0.0.1:80")
+	assert.NotZero(t, network.Snapshot().Drops.Policy)
+
+	// the host can still connect to the container, and gets its replies
+	conn, err = network.DialContext(context.Background(), "tcp", "10.0.0.2:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "from the host")
+}
+
+func TestPolicySpoofed(t *testing.T) {
+	network, err := NewNetwork(DefaultOptions())
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	db, err := network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	appContainer := newAttachedTestContainer(t, app)
+	echoContainerListener(t, newAttachedTestContainer(t, db), 80)
+
+	conn, err := appContainer.DialTCP(t, "10.0.0.3:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "from our own address")
+
+	// the same container can't pretend to be another one
+	spoofed := tcpip.Address(net.IPv4(10, 0, 0, 9).To4())
+	require.Nil(t, appContainer.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: spoofed.WithPrefix(),
+	}, stack.AddressProperties{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	_, err = gonet.DialTCPWithBind(ctx, appContainer.stack,
+		tcpip.FullAddress{NIC: nicID, Addr: spoofed},
+		appContainer.fullAddress(t, "10.0.0.3:80"), ipv4.ProtocolNumber)
+	assert.Error(t, err)
+	assert.NotZero(t, network.Snapshot().Drops.Spoofed)
+}
+
+// tcpPacket builds an IPv4 packet with a TCP header from src to dst
+func tcpPacket(src, dst string, sport, dport uint16) *stack.PacketBuffer {
+	buf := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	header.IPv4(buf).Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(src).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dst).To4()),
+	})
+	header.TCP(buf[header.IPv4MinimumSize:]).Encode(&header.TCPFields{
+		SrcPort:    sport,
+		DstPort:    dport,
+		DataOffset: header.TCPMinimumSize,
+	})
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{Data: buffer.View(buf).ToVectorisedView()})
+}
+
+func TestPolicyConntrack(t *testing.T) {
+	p := newPolicy(PolicyOptions{DenyEgress: true, Rules: []PolicyRule{
+		{From: "frontend", To: "backend", Action: PolicyAllow},
+	}})
+	app := &Attachment{segment: "frontend"}
+	db := &Attachment{segment: "backend"}
+	other := &Attachment{segment: "sandbox"}
+
+	assert.True(t, p.allowed(app, db, tcpPacket("10.0.0.2", "10.0.0.3", 1234, 80), header.IPv4Version))
+	assert.True(t, p.allowed(db, app, tcpPacket("10.0.0.3", "10.0.0.2", 80, 1234), header.IPv4Version))
+
+	// the reply only counts between the attachments the connection was allowed for
+	assert.False(t, p.allowed(other, app, tcpPacket("10.0.0.3", "10.0.0.2", 80, 1234), header.IPv4Version))
+	assert.False(t, p.allowed(db, nil, tcpPacket("10.0.0.3", "10.0.0.2", 80, 1234), header.IPv4Version))
+
+	p.forget(app)
+	assert.False(t, p.allowed(db, app, tcpPacket("10.0.0.3", "10.0.0.2", 80, 1234), header.IPv4Version))
+}
+
+func TestPolicyRuleOrder(t *testing.T) {
+	p := newPolicy(PolicyOptions{Rules: []PolicyRule{
+		{From: "a", To: "b", Action: PolicyDeny},
+		{From: SegmentAny, To: SegmentAny, Action: PolicyAllow},
+	}})
+
+	assert.False(t, p.allowedSegments("a", "b"))
+	assert.True(t, p.allowedSegments("b", "a"))
+	assert.True(t, p.allowedSegments("c", SegmentEgress))
+
+	p.set(PolicyOptions{DenyEgress: true})
+	assert.True(t, p.allowedSegments("a", "a"))
+	assert.False(t, p.allowedSegments("a", "b"))
+	assert.False(t, p.allowedSegments("a", SegmentEgress))
+}
@@ -0,0 +1,160 @@
+package host
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+// Publication is a container service published as a unix socket on the host, see PublishUnix
+type Publication struct {
+	tun      *TunDevice
+	listener net.Listener
+	path     string
+	addr     string
+
+	mutex  sync.Mutex
+	closed bool
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// PublishUnix makes addr in the container reachable through a unix socket at path on the host, which is created
+// with perm as its permissions. Unlike a TCP port only the users that can access path can connect to it.
+// The addr is passed to DialContext for every accepted connection, so on a Network it can be the name of an attachment.
+func (t *TunDevice) PublishUnix(path string, perm os.FileMode, addr string) (*Publication, error) {
+	listener, err := listenUnix(path, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Publication{
+		tun:      t,
+		listener: listener,
+		path:     path,
+		addr:     addr,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	t.publishMutex.Lock()
+	// checked while holding the lock, so Shutdown is guaranteed to close it
+	if err := t.Err(); err != nil {
+		t.publishMutex.Unlock()
+		listener.Close()
+		return nil, err
+	}
+	t.published[p] = struct{}{}
+	t.publishMutex.Unlock()
+
+	p.wg.Add(1)
+	go p.serve()
+
+	return p, nil
+}
+
+// Path returns the path of the unix socket
+func (p *Publication) Path() string {
+	return p.path
+}
+
+func (p *Publication) serve() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("Accepting on %s: %s", p.path, err)
+			}
+			return
+		}
+
+		if !p.track(conn) {
+			conn.Close()
+			return
+		}
+
+		p.wg.Add(1)
+		go p.handle(conn)
+	}
+}
+
+// track adds conn to the connections that are closed along with p, it returns false if p is closed already
+func (p *Publication) track(conn net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Publication) untrack(conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *Publication) handle(conn net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	target, err := p.tun.DialContext(p.tun.ctx, "tcp", p.addr)
+	if err != nil {
+		logrus.Debugf("Dialing %s for %s: %s", p.addr, p.path, err)
+		return
+	}
+	if !p.track(target) {
+		target.Close()
+		return
+	}
+	defer p.untrack(target)
+	defer target.Close()
+
+	_ = bridgeConns(conn, target)
+}
+
+// Close removes the socket and resets all of its connections
+func (p *Publication) Close() error {
+	p.tun.publishMutex.Lock()
+	delete(p.tun.published, p)
+	p.tun.publishMutex.Unlock()
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	// closing the listener removes the socket as well
+	err := p.listener.Close()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+// closePublished closes all the publications, as part of Shutdown
+func (t *TunDevice) closePublished() error {
+	t.publishMutex.Lock()
+	published := make([]*Publication, 0, len(t.published))
+	for p := range t.published {
+		published = append(published, p)
+	}
+	t.publishMutex.Unlock()
+
+	var err error
+	for _, p := range published {
+		err = multierr.Append(err, p.Close())
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package host
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishUnix(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	echoContainerListener(t, container, 8080)
+
+	path := filepath.Join(t.TempDir(), "service.sock")
+	p, err := tun.PublishUnix(path, 0600, "10.0.0.1:8080")
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello through a unix socket")
+
+	// closing resets the connections and removes the socket
+	require.NoError(t, p.Close())
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPublishUnixShutdown(t *testing.T) {
+	network, err := NewNetwork(DefaultOptions())
+	require.NoError(t, err)
+
+	db, err := network.NewAttachment("db", nil)
+	require.NoError(t, err)
+	echoContainerListener(t, newAttachedTestContainer(t, db), 5432)
+
+	path := filepath.Join(t.TempDir(), "db.sock")
+	_, err = network.PublishUnix(path, 0660, "db:5432")
+	require.NoError(t, err)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "select 1")
+
+	require.NoError(t, network.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = network.PublishUnix(path, 0600, "db:5432")
+	assert.Error(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,95 @@
+package host
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitOptions limits the bandwidth of the forwarded traffic, in both directions combined.
+// A BytesPerSecond of 0 means unlimited.
+type RateLimitOptions struct {
+	BytesPerSecond int `json:"bytes_per_second"`
+	Burst          int `json:"burst"`
+}
+
+// rateLimiter is shared by all the flows, it can be changed at runtime
+type rateLimiter struct {
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(opts RateLimitOptions) *rateLimiter {
+	out := &rateLimiter{
+		limiter: rate.NewLimiter(rate.Inf, 0),
+	}
+	out.set(opts)
+	return out
+}
+
+func (r *rateLimiter) set(opts RateLimitOptions) {
+	if opts.BytesPerSecond <= 0 {
+		r.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	burst := opts.Burst
+	if burst <= 0 {
+		burst = opts.BytesPerSecond
+	}
+	r.limiter.SetBurst(burst)
+	r.limiter.SetLimit(rate.Limit(opts.BytesPerSecond))
+}
+
+func (r *rateLimiter) get() RateLimitOptions {
+	if r.limiter.Limit() == rate.Inf {
+		return RateLimitOptions{}
+	}
+	return RateLimitOptions{
+		BytesPerSecond: int(r.limiter.Limit()),
+		Burst:          r.limiter.Burst(),
+	}
+}
+
+// wait blocks until n bytes are allowed to pass, or until ctx is done
+func (r *rateLimiter) wait(ctx context.Context, n int) error {
+	if r.limiter.Limit() == rate.Inf {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := n
+		if burst := r.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := r.limiter.WaitN(ctx, chunk); err != nil {
+			// the burst may have been lowered in the meantime, in which case we simply try again with a smaller chunk
+			if ctx.Err() != nil || chunk <= r.limiter.Burst() {
+				return err
+			}
+			continue
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// allow returns whether n bytes may pass right now, for the callers that can't wait. Anything larger than
+// the burst counts as the whole burst, as it would never be allowed otherwise.
+func (r *rateLimiter) allow(n int) bool {
+	if r.limiter.Limit() == rate.Inf {
+		return true
+	}
+	if burst := r.limiter.Burst(); n > burst {
+		n = burst
+	}
+	return r.limiter.AllowN(time.Now(), n)
+}
+
+func (t *TunDevice) SetRateLimit(opts RateLimitOptions) {
+	t.rateLimiter.set(opts)
+}
+
+func (t *TunDevice) RateLimit() RateLimitOptions {
+	return t.rateLimiter.get()
+}
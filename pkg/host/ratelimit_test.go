@@ -0,0 +1,29 @@
+package host
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitWait(t *testing.T) {
+	r := newRateLimiter(RateLimitOptions{BytesPerSecond: 10, Burst: 10})
+
+	// the burst passes straight away, everything after that can be given up on
+	assert.NoError(t, r.wait(context.Background(), 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	assert.Error(t, r.wait(ctx, 100))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the callers that can't wait are told to drop instead
+	assert.False(t, r.allow(100))
+
+	r.set(RateLimitOptions{})
+	assert.NoError(t, r.wait(context.Background(), 1000))
+	assert.True(t, r.allow(1000))
+}
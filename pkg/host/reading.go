@@ -1,7 +1,13 @@
 package host
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
 	"github.com/schoentoon/nsnet/pkg/common"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
@@ -9,25 +15,108 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-func (t *TunDevice) dispatchLoop() {
+func (a *Attachment) dispatchLoop() {
+	t := a.tun
+	defer t.wg.Done()
+	defer a.loop.Done()
+
 	buf := make([]byte, common.MTU)
 	for {
-		n, err := t.bridge.Read(buf)
-		if err != nil {
+		n, err := a.bridge.Read(buf)
+		if errors.Is(err, io.EOF) {
+			a.fail(ErrBridgeClosed)
+			return
+		} else if err != nil {
+			// when we closed the bridge ourselves the attachment was already detached, so this is a no-op
+			a.fail(fmt.Errorf("reading from bridge: %w", err))
 			return
 		}
+		t.capture.write(buf[:n])
+
+		if n == 0 {
+			atomic.AddUint64(&t.drops.Malformed, 1)
+			continue
+		}
 
 		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Data: buffer.NewVectorisedView(n, []buffer.View{buffer.NewViewFromBytes(buf)}),
+			Data: buffer.NewVectorisedView(n, []buffer.View{buffer.NewViewFromBytes(buf[:n])}),
 		})
-		switch header.IPVersion(buf) {
+		version := header.IPVersion(buf[:n])
+
+		if len(t.packetHooks) > 0 {
+			hooked := t.runPacketHooks(PacketFromContainer, pkb)
+			if hooked == nil {
+				pkb.DecRef()
+				continue
+			} else if hooked != pkb {
+				pkb.DecRef()
+				pkb = hooked
+				version = packetVersion(pkb)
+			}
+		}
+
+		// traffic between the containers of a Network never reaches the stack
+		if t.network != nil {
+			if a.spoofed(pkb, version) {
+				atomic.AddUint64(&t.drops.Spoofed, 1)
+				t.traceDeniedPacket(pkb, version, "spoofed")
+				pkb.DecRef()
+				continue
+			}
+			target := t.network.lookup(packetDestination(pkb, version))
+			if !t.network.allowed(a, target, pkb, version) {
+				atomic.AddUint64(&t.drops.Policy, 1)
+				t.traceDeniedPacket(pkb, version, "segment policy")
+				pkb.DecRef()
+				continue
+			}
+			if target != nil {
+				_ = target.writePacket(pkb)
+				pkb.DecRef()
+				continue
+			}
+		}
+
+		// echo requests to a host alias go to the host, rather than being answered by the stack
+		if req, ok := t.hostAliases.echoRequest(pkb, version); ok {
+			t.wg.Add(1)
+			go t.echoHostAlias(a, req)
+			pkb.DecRef()
+			continue
+		}
+
+		switch version {
 		case header.IPv4Version:
-			t.dispatcher.DeliverNetworkPacket(ipv4.ProtocolNumber, pkb)
+			a.endpoint.dispatcher.DeliverNetworkPacket(ipv4.ProtocolNumber, pkb)
 		case header.IPv6Version:
-			t.dispatcher.DeliverNetworkPacket(ipv6.ProtocolNumber, pkb)
+			a.endpoint.dispatcher.DeliverNetworkPacket(ipv6.ProtocolNumber, pkb)
+		default:
+			atomic.AddUint64(&t.drops.UnknownIPVersion, 1)
 		}
 
 		// it is important that we call DecRef() here, otherwise the memory of pkb will never be freed
 		pkb.DecRef()
 	}
 }
+
+func packetVersion(pkt *stack.PacketBuffer) int {
+	v, ok := pkt.Data().PullUp(1)
+	if !ok {
+		return -1
+	}
+	return header.IPVersion(v)
+}
+
+func packetDestination(pkt *stack.PacketBuffer, version int) tcpip.Address {
+	switch version {
+	case header.IPv4Version:
+		if v, ok := pkt.Data().PullUp(header.IPv4MinimumSize); ok {
+			return header.IPv4(v).DestinationAddress()
+		}
+	case header.IPv6Version:
+		if v, ok := pkt.Data().PullUp(header.IPv6MinimumSize); ok {
+			return header.IPv6(v).DestinationAddress()
+		}
+	}
+	return ""
+}
@@ -1,15 +1,16 @@
 package host
 
 import (
+	"context"
 	"errors"
-	"io"
+	"fmt"
 	"net"
-	"os"
+	"net/http"
 	"os/exec"
+	"sync"
 	"time"
 
-	"go.uber.org/multierr"
-	"golang.org/x/sys/unix"
+	"go.opentelemetry.io/otel/trace"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
@@ -24,6 +25,30 @@ const nicID = 1
 type Options struct {
 	UDPOptions UDPOptions
 	TCPOptions TCPOptions
+	FlowExport FlowExportOptions
+	Tracing    TracingOptions
+	RateLimit  RateLimitOptions
+
+	// Network is only used by NewNetwork
+	Network NetworkOptions
+
+	// PacketHooks are ran for every packet going to and coming from the container, see PacketHook
+	PacketHooks []PacketHook
+
+	// AdminSocket is the path of a unix socket to serve AdminHandler() on, it is disabled when empty
+	AdminSocket string
+
+	// Metadata is the metadata service at MetadataAddress
+	Metadata MetadataOptions
+
+	// HostAliases make addresses of the host reachable from the container, see HostAlias
+	HostAliases []HostAlias
+	// DNAT rewrites the destinations of the container, see DNATRule and SetDNAT
+	DNAT []DNATRule
+	// Services are load balanced VIPs, see Service and AddService
+	Services []Service
+	// Egress sends the traffic to some destinations out through other dialers, see EgressOptions
+	Egress EgressOptions
 }
 
 func DefaultOptions() Options {
@@ -39,46 +64,169 @@ func DefaultOptions() Options {
 			KeepaliveInterval: time.Second * 30,
 			Stats:             false,
 		},
+		FlowExport: FlowExportOptions{
+			ActiveTimeout: time.Second * 60,
+			IdleTimeout:   time.Second * 15,
+		},
+		Network: NetworkOptions{
+			Subnet: &net.IPNet{
+				IP:   net.IPv4(10, 0, 0, 0).To4(),
+				Mask: net.CIDRMask(24, 32),
+			},
+		},
 	}
 }
 
 type TunDevice struct {
+	// endpoint is the only NIC of a device created using New
 	endpoint *tunEndPoint
-	bridge   io.ReadWriteCloser
 
-	containerFd *os.File
+	// attachment is the bridge to the current container process, see NewAttachment
+	attachMutex sync.RWMutex
+	attachment  *Attachment
 
-	stack      *stack.Stack
-	dispatcher stack.NetworkDispatcher
+	stack *stack.Stack
+
+	// network is only set when created using NewNetwork
+	network *Network
 
 	udpHandler *udpHandler
 	tcpHandler *tcpHandler
+
+	flows    *flowTable
+	exporter *flowExporter
+
+	tracer   trace.Tracer
+	traceCtx context.Context
+
+	hostAliases *hostAliases
+	dnat        dnat
+	services    services
+	egress      *egressTable
+
+	capture     packetCapture
+	rateLimiter *rateLimiter
+	admin       *http.Server
+	metadata    *http.Server
+
+	drops       DropStats
+	snapshotter statsSnapshotter
+
+	packetHooks []PacketHook
+
+	// virtual are the services created using Listen
+	virtual virtualServices
+
+	publishMutex sync.Mutex
+	published    map[*Publication]struct{}
+
+	// ctx is cancelled when the device is shut down, wg tracks the dispatchLoops
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	lifecycle lifecycle
 }
 
+// stackAddress is the address of the stack of a device created using New, it is the source of the connections
+// made using DialContext. It has to differ from the addresses the container reaches the outside world on, as
+// those would end up at the stack itself otherwise.
+var stackAddress = tcpip.Address([]byte{10, 0, 0, 254})
+
+// New creates a device for a single container, see NewNetwork for multiple containers sharing a stack
 func New(opts Options) (out *TunDevice, err error) {
-	out = &TunDevice{
-		stack: stack.New(stack.Options{
-			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
-		}),
+	for _, alias := range opts.HostAliases {
+		if ipAddress(alias.Virtual) == stackAddress {
+			return nil, fmt.Errorf("%s is the address of the stack itself, it can't be a host alias", alias.Virtual)
+		}
 	}
+
+	out, err = newDevice(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	out.endpoint = &tunEndPoint{
 		tun: out,
 	}
 
-	fds, err := unix.Socketpair(unix.AF_LOCAL, unix.SOCK_STREAM|unix.SOCK_SEQPACKET, 0)
+	out.attachment, err = newAttachment(out, out.endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	out.bridge = os.NewFile(uintptr(fds[0]), "bridge")
-	out.containerFd = os.NewFile(uintptr(fds[1]), "bridge-container")
-
 	out.stack.AddRoute(tcpip.Route{
 		Destination: header.IPv4EmptySubnet,
 		NIC:         nicID,
 	})
 
+	if err := out.createNIC(nicID, out.endpoint, stackAddress); err != nil {
+		return nil, err
+	}
+
+	if opts.AdminSocket != "" {
+		if err := out.serveAdmin(opts.AdminSocket); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Metadata.Handler != nil {
+		if err := out.serveMetadata(opts.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// newDevice sets up everything but the NICs
+func newDevice(opts Options) (out *TunDevice, err error) {
+	out = &TunDevice{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		}),
+		flows:       newFlowTable(),
+		rateLimiter: newRateLimiter(opts.RateLimit),
+		packetHooks: opts.PacketHooks,
+		lifecycle:   newLifecycle(),
+		published:   make(map[*Publication]struct{}),
+		virtual: virtualServices{
+			listeners: make(map[virtualKey]*virtualListener),
+			conns:     make(map[virtualKey]*virtualPacketConn),
+		},
+		snapshotter: newStatsSnapshotter(),
+	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+	out.tracer, out.traceCtx = newTracer(opts.Tracing)
+
+	out.hostAliases, err = newHostAliases(opts.HostAliases, opts.TCPOptions.AllowHostConnections)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.SetDNAT(opts.DNAT); err != nil {
+		return nil, err
+	}
+	out.egress, err = newEgressTable(out, opts.Egress)
+	if err != nil {
+		return nil, err
+	}
+	out.services.byVIP = make(map[virtualKey]*service)
+	for _, svc := range opts.Services {
+		if err := out.AddService(svc); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.FlowExport.Collector != "" {
+		out.exporter, err = newFlowExporter(out.flows, opts.FlowExport)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	udpHandler, err := newUdpForwarder(out, opts.UDPOptions)
 	if err != nil {
 		return nil, err
@@ -91,43 +239,57 @@ func New(opts Options) (out *TunDevice, err error) {
 	}
 	out.tcpHandler = tcpHandler
 
-	tcpipErr := out.stack.CreateNIC(nicID, out.endpoint)
+	return out, nil
+}
+
+// createNIC creates a NIC that accepts all the traffic, regardless of the addresses
+func (t *TunDevice) createNIC(id tcpip.NICID, endpoint *tunEndPoint, addr tcpip.Address) error {
+	tcpipErr := t.stack.CreateNIC(id, endpoint)
 	if tcpipErr != nil {
-		return nil, errors.New(tcpipErr.String())
+		return errors.New(tcpipErr.String())
 	}
 
-	tcpipErr = out.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+	tcpipErr = t.stack.AddProtocolAddress(id, tcpip.ProtocolAddress{
 		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: tcpip.Address(net.IPv4(10, 0, 0, 1).To4()).WithPrefix(),
+		AddressWithPrefix: addr.WithPrefix(),
 	}, stack.AddressProperties{})
 	if tcpipErr != nil {
-		return nil, errors.New(tcpipErr.String())
+		return errors.New(tcpipErr.String())
 	}
 
-	tcpipErr = out.stack.SetPromiscuousMode(1, true)
+	tcpipErr = t.stack.SetPromiscuousMode(id, true)
 	if tcpipErr != nil {
-		return nil, errors.New(tcpipErr.String())
+		return errors.New(tcpipErr.String())
 	}
 
-	tcpipErr = out.stack.SetSpoofing(1, true)
+	tcpipErr = t.stack.SetSpoofing(id, true)
 	if tcpipErr != nil {
-		return nil, errors.New(tcpipErr.String())
+		return errors.New(tcpipErr.String())
 	}
 
-	return out, nil
+	return nil
 }
 
+// Close resets all the connections and releases everything, see Shutdown to gracefully drain the connections first
 func (t *TunDevice) Close() error {
-	return multierr.Combine(t.bridge.Close(),
-		t.udpHandler.Close(),
-		t.tcpHandler.Close(),
-	)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return t.Shutdown(ctx)
 }
 
+// AttachToCmd attaches cmd to the current attachment, see NewAttachment for restarting containers.
+// This can't be used on a Network, use AttachToCmd of the Attachment instead.
 func (t *TunDevice) AttachToCmd(cmd *exec.Cmd) {
-	if cmd.ExtraFiles == nil {
-		cmd.ExtraFiles = []*os.File{t.containerFd}
-	} else {
-		cmd.ExtraFiles = append(cmd.ExtraFiles, t.containerFd)
+	if t.network != nil {
+		panic(errNetworkAttachment)
+	}
+	t.current().AttachToCmd(cmd)
+}
+
+// Started has to be called once the cmd passed to AttachToCmd was started, see Attachment.Started
+func (t *TunDevice) Started() error {
+	if t.network != nil {
+		return errNetworkAttachment
 	}
+	return t.current().Started()
 }
@@ -0,0 +1,107 @@
+package host
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// how often we check whether all the flows are done while draining
+var drainInterval = time.Millisecond * 50
+
+// dial is used for all the outgoing connections, so dials in progress are aborted when shutting down
+func (t *TunDevice) dial(network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(t.ctx, network, addr)
+}
+
+// Shutdown stops accepting new TCP connections and UDP flows, after which it waits for the existing ones
+// to finish until ctx is done. Whatever remains after that is reset. Once Shutdown returns all the goroutines
+// and file descriptors of the device have been released.
+// It is safe to call Shutdown (or Close) concurrently, every call returns once the shutdown is complete.
+func (t *TunDevice) Shutdown(ctx context.Context) error {
+	t.shutdownOnce.Do(func() {
+		t.shutdownErr = t.shutdown(ctx)
+	})
+	return t.shutdownErr
+}
+
+func (t *TunDevice) shutdown(ctx context.Context) error {
+	t.lifecycle.stop(ErrDeviceClosed)
+	t.tcpHandler.stopAccepting()
+	t.udpHandler.stopAccepting()
+	t.closeVirtual()
+
+	t.drain(ctx)
+
+	// whatever is left gets reset, this includes connections that are still being dialed
+	t.cancel()
+	t.flows.Range(func(f *flow) bool {
+		_ = f.Close()
+		return true
+	})
+
+	err := multierr.Combine(
+		t.closePublished(),
+		t.tcpHandler.Close(),
+		t.udpHandler.Close(),
+	)
+	for _, attachment := range t.attachments() {
+		attachment.lifecycle.stop(ErrDeviceClosed)
+		err = multierr.Append(err, attachment.detach())
+		attachment.loop.Wait()
+	}
+
+	t.stack.Close()
+	t.stack.Wait()
+	t.wg.Wait()
+
+	if t.exporter != nil {
+		err = multierr.Append(err, t.exporter.Close())
+	}
+	if t.admin != nil {
+		err = multierr.Append(err, t.admin.Close())
+	}
+	if t.metadata != nil {
+		err = multierr.Append(err, t.metadata.Close())
+	}
+	return multierr.Append(err, t.StopCapture())
+}
+
+// drain blocks until all the TCP connections are done and there are no flows left, or until ctx is done.
+// Waiting for the TCP handler as well covers the connections that are still being dialed.
+func (t *TunDevice) drain(ctx context.Context) {
+	tcpDone := make(chan struct{})
+	go func() {
+		t.tcpHandler.wg.Wait()
+		close(tcpDone)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-tcpDone:
+	}
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		empty := true
+		t.flows.Range(func(*flow) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
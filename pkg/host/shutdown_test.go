@@ -0,0 +1,157 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+
+	container := newTestContainer(t, tun)
+	listener, port := hostListener(t)
+
+	release := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		<-release
+		_, _ = conn.Write([]byte("bye"))
+		conn.Close()
+	}()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		done <- tun.Shutdown(ctx)
+	}()
+
+	// new connections aren't forwarded while we're draining
+	assert.Eventually(t, func() bool {
+		tun.tcpHandler.mutex.RLock()
+		defer tun.tcpHandler.mutex.RUnlock()
+		return tun.tcpHandler.closing
+	}, time.Second, time.Millisecond*10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	_, err = gonet.DialContextTCP(ctx, container.stack, container.fullAddress(t, net.JoinHostPort("10.0.0.100", port)), ipv4.ProtocolNumber)
+	assert.Error(t, err)
+	assert.Equal(t, uint32(1), tun.Snapshot().TCP.Conns)
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a connection was still open")
+	default:
+	}
+
+	close(release)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(buf))
+	conn.Close()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Shutdown didn't return after the last connection was closed")
+	}
+}
+
+func TestShutdownResetsAfterDeadline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+
+	container := newTestContainer(t, tun)
+	listener, port := hostListener(t)
+
+	upstreamClosed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(upstreamClosed)
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, tun.Shutdown(ctx))
+	assert.Less(t, time.Since(start), time.Second*5)
+
+	select {
+	case <-upstreamClosed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the upstream connection wasn't closed")
+	}
+
+	count := 0
+	tun.flows.Range(func(*flow) bool {
+		count++
+		return true
+	})
+	assert.Zero(t, count)
+}
+
+func TestShutdownConcurrent(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+
+	container := newTestContainer(t, tun)
+	port := echoHostListener(t)
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				assert.NoError(t, tun.Close())
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+			assert.NoError(t, tun.Shutdown(ctx))
+		}(i)
+	}
+	wg.Wait()
+
+	// the container keeps on sending, which shouldn't upset the closed device
+	_, _ = conn.Write([]byte("anyone there?"))
+	assert.NoError(t, tun.Close())
+}
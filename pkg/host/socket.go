@@ -0,0 +1,57 @@
+package host
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/multierr"
+)
+
+// unixListener removes its socket once it is closed, as the socket was moved into place after it was created
+type unixListener struct {
+	net.Listener
+	path string
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// listenUnix creates a unix socket at path that has perm as its permissions from the very start. The socket is
+// created in a directory only we can access and linked into place once its permissions are set, so nobody can
+// connect to it in between. Changing the umask instead would affect the files of every other goroutine.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".nsnet")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// kept short, as the path of a unix socket is limited to about a hundred bytes
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the temporary path is gone by the time it's closed, we remove path ourselves instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	// unlike a rename this fails if path already exists, just like listening on it directly would
+	if err := multierr.Combine(os.Chmod(tmp, perm), os.Link(tmp, path)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+func (l *unixListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.Listener.Close()
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			l.closeErr = multierr.Append(l.closeErr, err)
+		}
+	})
+	return l.closeErr
+}
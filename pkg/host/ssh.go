@@ -0,0 +1,309 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errSSHClosed = errors.New("ssh egress is closed")
+
+// how long we wait before connecting to the jump host again after a failed attempt, this doubles with every
+// failure up to sshRetryMax
+var (
+	sshRetryMin = time.Second
+	sshRetryMax = time.Minute
+)
+
+// SSHOptions configures the connection to a jump host, the connections of the containers are carried over it
+type SSHOptions struct {
+	// Addr is the host:port of the jump host
+	Addr string
+	User string
+
+	// Signers are the keys to authenticate with, they are tried before the keys of the agent
+	Signers []ssh.Signer
+	// AgentSocket is the path of an ssh-agent to authenticate with, usually $SSH_AUTH_SOCK
+	AgentSocket string
+
+	// HostKeyCallback verifies the jump host, see knownhosts.New or ssh.FixedHostKey
+	HostKeyCallback ssh.HostKeyCallback
+
+	// KeepaliveInterval is how often the jump host is checked, the connection is reestablished once it stops
+	// answering. Defaults to 30 seconds.
+	KeepaliveInterval time.Duration
+	// Timeout limits how long connecting to the jump host may take, defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// SSH carries TCP connections over a single SSH connection to a jump host, using direct-tcpip channels like
+// ssh -J does. The connection is made again whenever it is lost. Use DialContext as an EgressDialer.
+type SSH struct {
+	opts SSHOptions
+
+	mutex  sync.Mutex
+	client *ssh.Client
+	// pending is the attempt to connect that is in progress, everybody that needs the connection waits for it
+	pending *sshAttempt
+	// retryAt is when we may connect again after failures attempts failed, until then lastErr is reported
+	failures int
+	retryAt  time.Time
+	lastErr  error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewSSH connects to the jump host, Close disconnects again
+func NewSSH(opts SSHOptions) (*SSH, error) {
+	if opts.HostKeyCallback == nil {
+		return nil, errors.New("the host key of the jump host has to be checked, use ssh.InsecureIgnoreHostKey() to skip this")
+	}
+	if len(opts.Signers) == 0 && opts.AgentSocket == "" {
+		return nil, errors.New("either Signers or AgentSocket is needed to authenticate")
+	}
+	if opts.KeepaliveInterval <= 0 {
+		opts.KeepaliveInterval = time.Second * 30
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 10
+	}
+
+	out := &SSH{opts: opts}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+
+	if _, err := out.current(context.Background()); err != nil {
+		out.cancel()
+		return nil, err
+	}
+	return out, nil
+}
+
+// sshAttempt is a single attempt to connect to the jump host, done is closed once it finished
+type sshAttempt struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// connect sets up a new connection to the jump host, this is aborted once the SSH is closed
+func (s *SSH) connect() (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: s.opts.Timeout}
+	conn, err := dialer.DialContext(s.ctx, "tcp", s.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := []ssh.AuthMethod{}
+	if len(s.opts.Signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(s.opts.Signers...))
+	}
+	if s.opts.AgentSocket != "" {
+		agentConn, err := net.Dial("unix", s.opts.AgentSocket)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// the agent is only needed during the handshake
+		defer agentConn.Close()
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+
+	// NewClientConn doesn't enforce the timeout itself, nor does it know about our ctx
+	_ = conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	handshake := make(chan struct{})
+	defer close(handshake)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-handshake:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.opts.Addr, &ssh.ClientConfig{
+		User:            s.opts.User,
+		Auth:            auth,
+		HostKeyCallback: s.opts.HostKeyCallback,
+		Timeout:         s.opts.Timeout,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// current returns the connection to the jump host, connecting again if it was lost. The connection is made
+// without holding the lock, so Close and the other dials aren't held up by a jump host that doesn't answer.
+func (s *SSH) current(ctx context.Context) (*ssh.Client, error) {
+	s.mutex.Lock()
+	// checked while holding the lock, so Close is guaranteed to see the connection
+	if s.ctx.Err() != nil {
+		s.mutex.Unlock()
+		return nil, errSSHClosed
+	}
+	if s.client != nil {
+		client := s.client
+		s.mutex.Unlock()
+		return client, nil
+	}
+
+	attempt := s.pending
+	if attempt == nil {
+		if time.Now().Before(s.retryAt) {
+			err := s.lastErr
+			s.mutex.Unlock()
+			return nil, err
+		}
+		attempt = &sshAttempt{done: make(chan struct{})}
+		s.pending = attempt
+		s.wg.Add(1)
+		go s.attempt(attempt)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.client, attempt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// attempt connects to the jump host on behalf of everybody waiting for attempt
+func (s *SSH) attempt(attempt *sshAttempt) {
+	defer s.wg.Done()
+	defer close(attempt.done)
+
+	client, err := s.connect()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = nil
+
+	if err == nil && s.ctx.Err() != nil {
+		client.Close()
+		err = errSSHClosed
+	}
+	if err != nil {
+		backoff := sshRetryMin << s.failures
+		if backoff > sshRetryMax || backoff <= 0 {
+			backoff = sshRetryMax
+		} else {
+			s.failures++
+		}
+		s.retryAt = time.Now().Add(backoff)
+		s.lastErr = err
+		attempt.err = err
+		return
+	}
+
+	s.failures = 0
+	s.client = client
+	attempt.client = client
+
+	s.wg.Add(1)
+	go s.keepalive(client)
+}
+
+// forget drops client if it is still the current connection, so the next dial connects again
+func (s *SSH) forget(client *ssh.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == client {
+		s.client = nil
+	}
+}
+
+// keepalive closes client once the jump host stops answering, and forgets it once it is closed
+func (s *SSH) keepalive(client *ssh.Client) {
+	defer s.wg.Done()
+
+	done := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+	defer func() { <-done }()
+	defer s.forget(client)
+
+	ticker := time.NewTicker(s.opts.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			client.Close()
+			return
+		case <-done:
+			logrus.Warnf("Lost the connection to jump host %s", s.opts.Addr)
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+		case <-time.After(s.opts.KeepaliveInterval):
+		case <-done:
+		}
+		client.Close()
+	}
+}
+
+// DialContext opens a connection to addr from the jump host, only TCP is supported
+func (s *SSH) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	// a connection that died without us noticing yet is replaced once, refusals of the jump host are not
+	for attempt := 0; ; attempt++ {
+		client, err := s.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// client.Dial doesn't take a ctx, the channel is closed if it shows up after ctx was cancelled
+		conn, err := dialContext(ctx, func() (net.Conn, error) {
+			return client.Dial(network, addr)
+		})
+		var refused *ssh.OpenChannelError
+		if err == nil || errors.As(err, &refused) || attempt > 0 || ctx.Err() != nil {
+			return conn, err
+		}
+
+		client.Close()
+		s.forget(client)
+	}
+}
+
+// Close disconnects from the jump host, the connections that were dialed through it are closed as well
+func (s *SSH) Close() error {
+	s.mutex.Lock()
+	s.cancel()
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
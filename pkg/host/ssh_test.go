@@ -0,0 +1,312 @@
+package host
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshJumpHost is a minimal SSH server that only supports direct-tcpip channels
+type sshJumpHost struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	mutex sync.Mutex
+	conns []net.Conn
+	// stalled makes the jump host accept connections without ever answering them
+	stalled bool
+}
+
+func newSSHKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return key, signer
+}
+
+func newSSHJumpHost(t *testing.T, authorized ssh.PublicKey) *sshJumpHost {
+	_, hostKey := newSSHKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, assert.AnError
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	out := &sshJumpHost{addr: listener.Addr().String(), hostKey: hostKey.PublicKey()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			out.mutex.Lock()
+			out.conns = append(out.conns, conn)
+			stalled := out.stalled
+			out.mutex.Unlock()
+			if !stalled {
+				go out.serve(conn, config)
+			}
+		}
+	}()
+	t.Cleanup(out.disconnect)
+	return out
+}
+
+func (j *sshJumpHost) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			defer channel.Close()
+			defer upstream.Close()
+			go func() { _, _ = io.Copy(upstream, channel) }()
+			_, _ = io.Copy(channel, upstream)
+		}()
+	}
+}
+
+// disconnect drops all the SSH connections, as if the jump host restarted
+func (j *sshJumpHost) disconnect() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, conn := range j.conns {
+		conn.Close()
+	}
+	j.conns = nil
+}
+
+func (j *sshJumpHost) stall() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.stalled = true
+}
+
+func (j *sshJumpHost) connections() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return len(j.conns)
+}
+
+func TestSSHEgress(t *testing.T) {
+	tcpPort := echoHostListener(t)
+	_, signer := newSSHKey(t)
+	jump := newSSHJumpHost(t, signer.PublicKey())
+
+	egress, err := NewSSH(SSHOptions{
+		Addr:            jump.addr,
+		User:            "test",
+		Signers:         []ssh.Signer{signer},
+		HostKeyCallback: ssh.FixedHostKey(jump.hostKey),
+	})
+	require.NoError(t, err)
+	defer egress.Close()
+
+	// the jump host is the only one that can reach the private network, so 198.51.100.1 stands in for its loopback
+	opts := DefaultOptions()
+	opts.DNAT = []DNATRule{{Match: "198.51.100.1", Target: "127.0.0.1"}}
+	opts.Egress = EgressOptions{
+		Dialers: map[string]EgressDialer{"bastion": egress.DialContext},
+		Routes:  []EgressRoute{{CIDR: mustCIDR(t, "127.0.0.0/8"), Egress: "bastion"}},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	// all the connections share a single SSH connection
+	for i := 0; i < 3; i++ {
+		conn, err := container.DialTCP(t, net.JoinHostPort("198.51.100.1", tcpPort))
+		require.NoError(t, err)
+		echo(t, conn, "hello from behind the bastion")
+		conn.Close()
+	}
+	assert.Equal(t, 1, jump.connections())
+
+	// losing the connection to the jump host isn't noticed by the next container connection
+	jump.disconnect()
+	conn, err := container.DialTCP(t, net.JoinHostPort("198.51.100.1", tcpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello again")
+
+	assert.EqualValues(t, 4, tun.Snapshot().Egress["bastion"].TCPConns)
+
+	_, err = egress.DialContext(tun.ctx, "udp", "127.0.0.1:53")
+	assert.Error(t, err)
+}
+
+func TestSSHStalled(t *testing.T) {
+	_, signer := newSSHKey(t)
+	jump := newSSHJumpHost(t, signer.PublicKey())
+
+	egress, err := NewSSH(SSHOptions{
+		Addr:            jump.addr,
+		User:            "test",
+		Signers:         []ssh.Signer{signer},
+		HostKeyCallback: ssh.FixedHostKey(jump.hostKey),
+		Timeout:         time.Second * 30,
+	})
+	require.NoError(t, err)
+
+	// the dials give up when their ctx does, even though connecting again takes forever
+	jump.stall()
+	jump.disconnect()
+	require.Eventually(t, func() bool {
+		egress.mutex.Lock()
+		defer egress.mutex.Unlock()
+		return egress.client == nil
+	}, time.Second*5, time.Millisecond*10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancel()
+			_, err := egress.DialContext(ctx, "tcp", "127.0.0.1:1")
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		}()
+	}
+	wg.Wait()
+	// all of them waited for the same attempt
+	assert.Equal(t, 1, jump.connections())
+
+	// and closing doesn't wait for it either
+	start := time.Now()
+	require.NoError(t, egress.Close())
+	assert.Less(t, time.Since(start), time.Second*5)
+
+	_, err = egress.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, errSSHClosed)
+}
+
+func TestSSHBackoff(t *testing.T) {
+	_, signer := newSSHKey(t)
+	jump := newSSHJumpHost(t, signer.PublicKey())
+
+	egress, err := NewSSH(SSHOptions{
+		Addr:            jump.addr,
+		User:            "test",
+		Signers:         []ssh.Signer{signer},
+		HostKeyCallback: ssh.FixedHostKey(jump.hostKey),
+		Timeout:         time.Millisecond * 100,
+	})
+	require.NoError(t, err)
+	defer egress.Close()
+
+	jump.stall()
+	jump.disconnect()
+	require.Eventually(t, func() bool {
+		egress.mutex.Lock()
+		defer egress.mutex.Unlock()
+		return egress.client == nil
+	}, time.Second*5, time.Millisecond*10)
+
+	_, err = egress.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	require.Error(t, err)
+
+	// until the backoff passed the failure is reported without trying again
+	_, err = egress.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	require.Error(t, err)
+	assert.Equal(t, 1, jump.connections())
+}
+
+func TestSSHAgent(t *testing.T) {
+	tcpPort := echoHostListener(t)
+	key, signer := newSSHKey(t)
+	jump := newSSHJumpHost(t, signer.PublicKey())
+
+	other, _ := newSSHKey(t)
+	keyring := agent.NewKeyring()
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: other}))
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	// the agent holds a different key than the one the jump host accepts
+	_, err = NewSSH(SSHOptions{
+		Addr:            jump.addr,
+		AgentSocket:     socket,
+		HostKeyCallback: ssh.FixedHostKey(jump.hostKey),
+	})
+	assert.Error(t, err)
+
+	require.NoError(t, keyring.RemoveAll())
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+
+	egress, err := NewSSH(SSHOptions{
+		Addr:            jump.addr,
+		AgentSocket:     socket,
+		HostKeyCallback: ssh.FixedHostKey(jump.hostKey),
+	})
+	require.NoError(t, err)
+	defer egress.Close()
+
+	conn, err := egress.DialContext(egress.ctx, "tcp", net.JoinHostPort("127.0.0.1", tcpPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello agent")
+}
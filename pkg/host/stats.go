@@ -0,0 +1,167 @@
+package host
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DropStats counts the packets and connections that were dropped, by the reason they were dropped for
+type DropStats struct {
+	UDPQueueFull      uint64 `json:"udp_queue_full"`
+	Malformed         uint64 `json:"malformed"`
+	UnknownIPVersion  uint64 `json:"unknown_ip_version"`
+	DialFailed        uint64 `json:"dial_failed"`
+	BridgeWriteFailed uint64 `json:"bridge_write_failed"`
+	Policy            uint64 `json:"policy"`
+	// Spoofed are the packets a container on a Network sent from an address that isn't its own
+	Spoofed uint64 `json:"spoofed"`
+	// RateLimited are the UDP packets from the containers that exceeded the rate limit
+	RateLimited uint64 `json:"rate_limited"`
+}
+
+// StatsRates are the throughput rates per second, averaged over the last sampling interval
+type StatsRates struct {
+	TCPSentBytes   float64 `json:"tcp_sent_bytes"`
+	TCPRecvBytes   float64 `json:"tcp_recv_bytes"`
+	UDPSentBytes   float64 `json:"udp_sent_bytes"`
+	UDPRecvBytes   float64 `json:"udp_recv_bytes"`
+	UDPSentPackets float64 `json:"udp_sent_packets"`
+	UDPRecvPackets float64 `json:"udp_recv_packets"`
+}
+
+// StatsSnapshot is a copy of all the counters. Every counter is read on its own, so counters that are updated
+// together, like the bytes and the packets, can be slightly out of step when traffic is flowing.
+type StatsSnapshot struct {
+	Time  time.Time  `json:"time"`
+	TCP   TCPStats   `json:"tcp"`
+	UDP   UDPStats   `json:"udp"`
+	Drops DropStats  `json:"drops"`
+	Rates StatsRates `json:"rates"`
+	// Egress are the counters of each egress by its name
+	Egress map[string]EgressStats `json:"egress"`
+}
+
+// the rates are computed over samples that are at least this far apart
+const statsRateInterval = time.Second
+
+// statsSnapshotter keeps the two most recent samples, so we can compute the rates. A sample is only taken once
+// the newest one is older than the interval, this way every caller of Snapshot sees the same rates no matter
+// how often any of them calls it.
+type statsSnapshotter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	older    StatsSnapshot
+	newer    StatsSnapshot
+}
+
+func newStatsSnapshotter() statsSnapshotter {
+	now := time.Now()
+	return statsSnapshotter{
+		interval: statsRateInterval,
+		older:    StatsSnapshot{Time: now},
+		newer:    StatsSnapshot{Time: now},
+	}
+}
+
+func loadTCPStats(stats *TCPStats) TCPStats {
+	return TCPStats{
+		Conns:     atomic.LoadUint32(&stats.Conns),
+		SentBytes: atomic.LoadUint64(&stats.SentBytes),
+		RecvBytes: atomic.LoadUint64(&stats.RecvBytes),
+	}
+}
+
+func loadUDPStats(stats *UDPStats) UDPStats {
+	return UDPStats{
+		SentPacket: atomic.LoadUint32(&stats.SentPacket),
+		RecvPacket: atomic.LoadUint32(&stats.RecvPacket),
+		SentBytes:  atomic.LoadUint64(&stats.SentBytes),
+		RecvBytes:  atomic.LoadUint64(&stats.RecvBytes),
+	}
+}
+
+func loadDropStats(stats *DropStats) DropStats {
+	return DropStats{
+		UDPQueueFull:      atomic.LoadUint64(&stats.UDPQueueFull),
+		Malformed:         atomic.LoadUint64(&stats.Malformed),
+		UnknownIPVersion:  atomic.LoadUint64(&stats.UnknownIPVersion),
+		DialFailed:        atomic.LoadUint64(&stats.DialFailed),
+		BridgeWriteFailed: atomic.LoadUint64(&stats.BridgeWriteFailed),
+		Policy:            atomic.LoadUint64(&stats.Policy),
+		Spoofed:           atomic.LoadUint64(&stats.Spoofed),
+		RateLimited:       atomic.LoadUint64(&stats.RateLimited),
+	}
+}
+
+func perSecond(current, previous uint64, elapsed float64) float64 {
+	if elapsed <= 0 || current < previous {
+		return 0
+	}
+	return float64(current-previous) / elapsed
+}
+
+// Snapshot returns a copy of all the counters, this works regardless of the Stats options.
+// The rates are averaged over the last sampling interval, which is at least a second long. Calling Snapshot
+// doesn't affect the rates other callers see, so the admin socket can be polled next to your own monitoring.
+func (t *TunDevice) Snapshot() StatsSnapshot {
+	t.snapshotter.mutex.Lock()
+	defer t.snapshotter.mutex.Unlock()
+
+	out := StatsSnapshot{
+		Time:   time.Now(),
+		TCP:    loadTCPStats(t.tcpHandler.stats),
+		UDP:    loadUDPStats(t.udpHandler.stats),
+		Drops:  loadDropStats(&t.drops),
+		Egress: t.egress.snapshot(),
+	}
+
+	s := &t.snapshotter
+	if out.Time.Sub(s.newer.Time) >= s.interval {
+		s.older, s.newer = s.newer, out
+	}
+
+	older, newer := s.older, s.newer
+	elapsed := newer.Time.Sub(older.Time).Seconds()
+	out.Rates = StatsRates{
+		TCPSentBytes:   perSecond(newer.TCP.SentBytes, older.TCP.SentBytes, elapsed),
+		TCPRecvBytes:   perSecond(newer.TCP.RecvBytes, older.TCP.RecvBytes, elapsed),
+		UDPSentBytes:   perSecond(newer.UDP.SentBytes, older.UDP.SentBytes, elapsed),
+		UDPRecvBytes:   perSecond(newer.UDP.RecvBytes, older.UDP.RecvBytes, elapsed),
+		UDPSentPackets: perSecond(uint64(newer.UDP.SentPacket), uint64(older.UDP.SentPacket), elapsed),
+		UDPRecvPackets: perSecond(uint64(newer.UDP.RecvPacket), uint64(older.UDP.RecvPacket), elapsed),
+	}
+	return out
+}
+
+// ResetStats sets all the counters back to zero
+func (t *TunDevice) ResetStats() {
+	t.snapshotter.mutex.Lock()
+	defer t.snapshotter.mutex.Unlock()
+
+	tcp := t.tcpHandler.stats
+	atomic.StoreUint32(&tcp.Conns, 0)
+	atomic.StoreUint64(&tcp.SentBytes, 0)
+	atomic.StoreUint64(&tcp.RecvBytes, 0)
+
+	udp := t.udpHandler.stats
+	atomic.StoreUint32(&udp.SentPacket, 0)
+	atomic.StoreUint32(&udp.RecvPacket, 0)
+	atomic.StoreUint64(&udp.SentBytes, 0)
+	atomic.StoreUint64(&udp.RecvBytes, 0)
+
+	atomic.StoreUint64(&t.drops.UDPQueueFull, 0)
+	atomic.StoreUint64(&t.drops.Malformed, 0)
+	atomic.StoreUint64(&t.drops.UnknownIPVersion, 0)
+	atomic.StoreUint64(&t.drops.DialFailed, 0)
+	atomic.StoreUint64(&t.drops.BridgeWriteFailed, 0)
+	atomic.StoreUint64(&t.drops.Policy, 0)
+	atomic.StoreUint64(&t.drops.Spoofed, 0)
+	atomic.StoreUint64(&t.drops.RateLimited, 0)
+
+	t.egress.reset()
+
+	now := time.Now()
+	t.snapshotter.older = StatsSnapshot{Time: now}
+	t.snapshotter.newer = StatsSnapshot{Time: now}
+}
@@ -0,0 +1,85 @@
+package host
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+	tun.snapshotter.interval = time.Millisecond * 100
+
+	// stats weren't enabled, but the snapshot should work regardless
+	assert.Nil(t, tun.TCPStats())
+
+	container := newTestContainer(t, tun)
+	listener, port := hostListener(t)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	conn.Close()
+
+	snapshot := tun.Snapshot()
+	assert.WithinDuration(t, time.Now(), snapshot.Time, time.Second)
+	assert.Equal(t, TCPStats{Conns: 1, SentBytes: 4, RecvBytes: 4}, snapshot.TCP)
+
+	// the rates only change once per interval, regardless of how often they're asked for
+	require.Eventually(t, func() bool {
+		return tun.Snapshot().Rates.TCPSentBytes > 0
+	}, time.Second*5, time.Millisecond*10)
+	rates := tun.Snapshot().Rates
+	assert.Greater(t, rates.TCPRecvBytes, float64(0))
+	assert.Equal(t, rates, tun.Snapshot().Rates)
+
+	// nothing happened in the meantime, so the rates should be back at zero after the next interval
+	require.Eventually(t, func() bool {
+		return tun.Snapshot().Rates == StatsRates{}
+	}, time.Second*5, time.Millisecond*10)
+
+	tun.ResetStats()
+	assert.Equal(t, TCPStats{}, tun.Snapshot().TCP)
+}
+
+func TestSnapshotDialFailed(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	listener, port := hostListener(t)
+	listener.Close()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	if err == nil {
+		conn.Close()
+	}
+
+	require.Eventually(t, func() bool {
+		return tun.Snapshot().Drops.DialFailed == 1
+	}, time.Second*5, time.Millisecond*10)
+}
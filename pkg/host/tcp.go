@@ -1,29 +1,43 @@
 package host
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.uber.org/multierr"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
-	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 const defaultWndSize = 0
 
+var errNoCloseWrite = errors.New("the connection can't be half closed")
+
 type TCPOptions struct {
-	MaxConns             int
-	KeepaliveIdle        time.Duration
-	KeepaliveInterval    time.Duration
-	Stats                bool
+	MaxConns          int
+	KeepaliveIdle     time.Duration
+	KeepaliveInterval time.Duration
+	// Stats makes TCPStats() return the live counters, TunDevice.Snapshot() works regardless
+	Stats bool
+	// AllowHostConnections makes the host loopback reachable at 10.0.0.100, for both TCP and UDP.
+	// This is a shorthand for a HostAlias of 10.0.0.100 to 127.0.0.1 that allows all ports.
 	AllowHostConnections bool
-	Dialer               func(network, addr string) (net.Conn, error)
+	// Dialer dials the connections of the direct egress, see EgressOptions
+	Dialer func(network, addr string) (net.Conn, error)
+
+	// Middleware wraps the relay between the container and the upstream connection, see ConnMiddleware
+	Middleware []ConnMiddleware
+
+	// UnixSockets maps virtual ip:port addresses to unix sockets on the host, this way the container can reach a
+	// single host service (docker.sock, ssh-agent) without seeing the rest of the host
+	UnixSockets map[string]string
 }
 
 type tcpHandler struct {
@@ -31,14 +45,24 @@ type tcpHandler struct {
 	dialer func(network, addr string) (net.Conn, error)
 
 	stats                *TCPStats
+	exposeStats          bool
 	allowHostConnections bool
+
+	relay ConnRelay
+
+	unixSockets map[string]string
+
+	// mutex makes sure that once closing is set, every accepted connection is accounted for in wg
+	mutex   sync.RWMutex
+	closing bool
+	wg      sync.WaitGroup
 }
 
 type TCPStats struct {
-	Conns uint32
+	Conns uint32 `json:"conns"`
 
-	SentBytes uint64
-	RecvBytes uint64
+	SentBytes uint64 `json:"sent_bytes"`
+	RecvBytes uint64 `json:"recv_bytes"`
 }
 
 // mostly based on https://github.com/xjasonlyu/tun2socks/blob/main/tunnel/tcp.go
@@ -48,35 +72,62 @@ func newTcpForwarder(t *TunDevice, opts TCPOptions) (*tcpHandler, error) {
 		tun:                  t,
 		allowHostConnections: opts.AllowHostConnections,
 		dialer:               opts.Dialer,
+		stats:                new(TCPStats),
+		exposeStats:          opts.Stats,
+		relay:                chainMiddleware(opts.Middleware),
 	}
-	if out.dialer == nil {
-		out.dialer = net.Dial
-	}
-
-	if opts.Stats {
-		out.stats = new(TCPStats)
+	unixSockets, err := parseUnixSockets(opts.UnixSockets)
+	if err != nil {
+		return nil, err
 	}
+	out.unixSockets = unixSockets
 
 	tcpForwarder := tcp.NewForwarder(t.stack, defaultWndSize, opts.MaxConns, func(r *tcp.ForwarderRequest) {
-		var wq waiter.Queue
+		out.mutex.RLock()
+		if out.closing {
+			out.mutex.RUnlock()
+			r.Complete(true)
+			return
+		}
+		out.wg.Add(1)
+		out.mutex.RUnlock()
+
+		// ports of the host that aren't allowed are refused as if they're closed
 		id := r.ID()
+		if _, ok := t.hostAliases.rewrite(id.LocalAddress, id.LocalPort); !ok {
+			atomic.AddUint64(&t.drops.Policy, 1)
+			t.traceDenied(tcp.ProtocolNumber, id, "host alias port")
+			out.wg.Done()
+			r.Complete(true)
+			return
+		}
+
+		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
+			out.wg.Done()
 			r.Complete(true)
 			return
 		}
 		r.Complete(false)
 
-		var conn net.Conn
-		conn = gonet.NewTCPConn(&wq, ep)
-		if out.stats != nil {
-			atomic.AddUint32(&out.stats.Conns, 1)
-			conn = newTcpTracker(out.stats, conn)
-		}
+		atomic.AddUint32(&out.stats.Conns, 1)
+
+		f := newFlow(tcp.ProtocolNumber, id)
+		conn := newTcpTracker(out.stats, f, t.rateLimiter, gonet.NewTCPConn(&wq, ep))
 
 		out.setKeepalive(ep, opts)
 
-		go out.handleTcp(conn, &id)
+		// connections to a virtual service are handed to its listener, they're owned by whoever accepts them
+		if l := t.virtualListener(id); l != nil {
+			out.wg.Done()
+			if !l.deliver(conn) {
+				_ = conn.Close()
+			}
+			return
+		}
+
+		go out.handleTcp(conn, f)
 	})
 
 	t.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
@@ -84,12 +135,24 @@ func newTcpForwarder(t *TunDevice, opts TCPOptions) (*tcpHandler, error) {
 	return out, nil
 }
 
+// stopAccepting resets all new connections, existing connections are left alone
+func (h *tcpHandler) stopAccepting() {
+	h.mutex.Lock()
+	h.closing = true
+	h.mutex.Unlock()
+}
+
+// Close waits for all the connections to be done, so they should be closed first
 func (h *tcpHandler) Close() error {
-	// TODO: We should kill all the connections
+	h.stopAccepting()
+	h.wg.Wait()
 	return nil
 }
 
 func (h *tcpHandler) Stats() *TCPStats {
+	if !h.exposeStats {
+		return nil
+	}
 	return h.stats
 }
 
@@ -113,55 +176,150 @@ func (h *tcpHandler) setKeepalive(ep tcpip.Endpoint, opts TCPOptions) {
 
 var fakeLocal = tcpip.Address([]byte{10, 0, 0, 100})
 
-func (h *tcpHandler) handleTcp(conn net.Conn, id *stack.TransportEndpointID) {
+// parseUnixSockets normalizes the addresses of TCPOptions.UnixSockets, so they can be looked up by the address of a flow
+func parseUnixSockets(sockets map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(sockets))
+	for addr, path := range sockets {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unix socket address %s: %w", addr, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid unix socket address %s", addr)
+		}
+		out[net.JoinHostPort(net.IP(ipAddress(ip)).String(), port)] = path
+	}
+	return out, nil
+}
+
+func (h *tcpHandler) handleTcp(conn net.Conn, f *flow) {
+	defer h.wg.Done()
 	defer conn.Close()
 
-	if h.allowHostConnections && id.LocalAddress.To4() == fakeLocal {
-		id.LocalAddress = tcpip.Address([]byte{127, 0, 0, 1})
+	ctx, span := h.tun.startFlowSpan("tcp.forward", f)
+
+	// DNS over TCP to the gateway is answered by us, just like over UDP
+	if dns := h.tun.dnsServer(); dns != nil && dns.intercepts(f.id) {
+		f.closer = conn.Close
+		h.tun.flows.add(f)
+		defer h.tun.flows.remove(f)
+
+		err := dns.serveTCP(conn, func() (net.Conn, error) {
+			if dns.upstream == "" {
+				return nil, errNoUpstream
+			}
+			span.SetAttributes(rewriteKey.String(dns.upstream))
+			return h.tun.dialEgress(ctx, f, "tcp", dns.upstream)
+		})
+		endFlowSpan(span, f, err)
+		return
+	}
+
+	network := "tcp"
+	upstream, rewrite := h.tun.upstream("tcp", f.id.LocalAddress, f.id.LocalPort)
+	if rewrite != "" {
+		span.SetAttributes(rewriteKey.String(rewrite))
+	}
+	if path, ok := h.unixSockets[net.JoinHostPort(f.id.LocalAddress.String(), strconv.Itoa(int(f.id.LocalPort)))]; ok {
+		network, upstream = "unix", path
+		span.SetAttributes(rewriteKey.String(path))
 	}
 
-	target, err := net.Dial("tcp", fmt.Sprintf("%s:%d", id.LocalAddress, id.LocalPort))
+	var target net.Conn
+	var err error
+	if svc := h.tun.service(f.id.LocalAddress, f.id.LocalPort); svc != nil {
+		var done func()
+		target, upstream, done, err = svc.dial(ctx, h.tun, f)
+		if err == nil {
+			defer done()
+			span.SetAttributes(rewriteKey.String(upstream))
+		}
+	} else {
+		target, err = h.tun.dialEgress(ctx, f, network, upstream)
+	}
 	if err != nil {
+		atomic.AddUint64(&h.tun.drops.DialFailed, 1)
+		endFlowSpan(span, f, err)
 		return
 	}
 	defer target.Close()
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	f.closer = func() error {
+		return multierr.Combine(conn.Close(), target.Close())
+	}
+	h.tun.flows.add(f)
+	defer h.tun.flows.remove(f)
 
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(target, conn)
-	}()
+	// the flows may have been reset right before we were added
+	if err := h.tun.ctx.Err(); err != nil {
+		endFlowSpan(span, f, err)
+		return
+	}
 
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(conn, target)
-	}()
+	info := &FlowInfo{
+		ID:          f.serial,
+		Container:   &net.TCPAddr{IP: net.IP(f.id.RemoteAddress), Port: int(f.id.RemotePort)},
+		Destination: &net.TCPAddr{IP: net.IP(f.id.LocalAddress), Port: int(f.id.LocalPort)},
+		Upstream:    upstream,
+	}
 
-	wg.Wait()
+	err = h.relay(ctx, info, conn, target)
+	endFlowSpan(span, f, err)
 }
 
+// tcpTracker counts the traffic of the container side of a connection
 type tcpTracker struct {
 	net.Conn
-	stats *TCPStats
+	stats   *TCPStats
+	flow    *flow
+	limiter *rateLimiter
 }
 
-func newTcpTracker(stats *TCPStats, conn net.Conn) *tcpTracker {
+func newTcpTracker(stats *TCPStats, f *flow, limiter *rateLimiter, conn net.Conn) *tcpTracker {
 	return &tcpTracker{
-		Conn:  conn,
-		stats: stats,
+		Conn:    conn,
+		stats:   stats,
+		flow:    f,
+		limiter: limiter,
 	}
 }
 
 func (t *tcpTracker) Read(b []byte) (int, error) {
 	n, err := t.Conn.Read(b)
+	if n > 0 {
+		// the flow is going away if this fails, so what we read doesn't matter anymore
+		if err := t.limiter.wait(t.flow.ctx, n); err != nil {
+			return 0, err
+		}
+		t.flow.addEgress(n)
+	}
 	atomic.AddUint64(&t.stats.RecvBytes, uint64(n))
 	return n, err
 }
 
 func (t *tcpTracker) Write(b []byte) (int, error) {
+	if err := t.limiter.wait(t.flow.ctx, len(b)); err != nil {
+		return 0, err
+	}
 	n, err := t.Conn.Write(b)
+	if n > 0 {
+		t.flow.addIngress(n)
+	}
 	atomic.AddUint64(&t.stats.SentBytes, uint64(n))
 	return n, err
 }
+
+// CloseWrite passes the end of the upstream on to the container
+func (t *tcpTracker) CloseWrite() error {
+	if cw, ok := t.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
+// Close stops whatever is still waiting on the rate limit for this connection as well
+func (t *tcpTracker) Close() error {
+	t.flow.cancel()
+	return t.Conn.Close()
+}
@@ -0,0 +1,52 @@
+package host
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSockets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	opts := DefaultOptions()
+	opts.TCPOptions.UnixSockets = map[string]string{
+		"10.0.0.200:2375": path,
+		// the host alias can be mapped as well, without allowing any other host connections
+		"10.0.0.100:2375": path,
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	for _, addr := range []string{"10.0.0.200:2375", "10.0.0.100:2375"} {
+		conn, err := container.DialTCP(t, addr)
+		require.NoError(t, err)
+		echo(t, conn, "GET /containers/json")
+		conn.Close()
+	}
+
+	opts.TCPOptions.UnixSockets = map[string]string{"docker": path}
+	_, err = New(opts)
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package host
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const tracerName = "github.com/schoentoon/nsnet/pkg/host"
+
+// TracingOptions configures the OpenTelemetry spans created for every forwarded TCP connection and UDP flow.
+// Flows refused by policy get a short span too, with nsnet.policy set to deny and nsnet.policy.reason saying why.
+// Context is used as the parent of all these spans, if TracerProvider is nil the global provider is used.
+type TracingOptions struct {
+	Context        context.Context
+	TracerProvider trace.TracerProvider
+}
+
+var (
+	rewriteKey      = attribute.Key("nsnet.rewrite")
+	egressNameKey   = attribute.Key("nsnet.egress.name")
+	egressBytesKey  = attribute.Key("nsnet.egress.bytes")
+	ingressBytesKey = attribute.Key("nsnet.ingress.bytes")
+	endReasonKey    = attribute.Key("nsnet.end_reason")
+	policyKey       = attribute.Key("nsnet.policy")
+	policyReasonKey = attribute.Key("nsnet.policy.reason")
+)
+
+func newTracer(opts TracingOptions) (trace.Tracer, context.Context) {
+	provider := opts.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return provider.Tracer(tracerName), ctx
+}
+
+// startFlowSpan starts the span that covers the entire lifetime of f
+func (t *TunDevice) startFlowSpan(name string, f *flow) (context.Context, trace.Span) {
+	return t.startSpan(name, f.proto, f.id, f.start, policyKey.String("allow"))
+}
+
+// traceDenied records a span for a flow that was refused by policy before it even started, reason says which one
+func (t *TunDevice) traceDenied(proto tcpip.TransportProtocolNumber, id stack.TransportEndpointID, reason string) {
+	name := "ip.forward"
+	switch proto {
+	case tcp.ProtocolNumber:
+		name = "tcp.forward"
+	case udp.ProtocolNumber:
+		name = "udp.forward"
+	}
+
+	_, span := t.startSpan(name, proto, id, time.Now(), policyKey.String("deny"), policyReasonKey.String(reason))
+	span.SetStatus(codes.Error, "denied by policy: "+reason)
+	span.End()
+}
+
+// traceDeniedPacket is traceDenied for a packet from a container that was dropped before it reached the stack
+func (t *TunDevice) traceDeniedPacket(pkt *stack.PacketBuffer, version int, reason string) {
+	key, ok := packetConnKey(pkt, version)
+	if !ok {
+		return
+	}
+	t.traceDenied(key.proto, stack.TransportEndpointID{
+		LocalAddress:  key.dst,
+		LocalPort:     key.dport,
+		RemoteAddress: key.src,
+		RemotePort:    key.sport,
+	}, reason)
+}
+
+func (t *TunDevice) startSpan(name string, proto tcpip.TransportProtocolNumber, id stack.TransportEndpointID, start time.Time, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	transport := semconv.NetTransportIP
+	switch proto {
+	case tcp.ProtocolNumber:
+		transport = semconv.NetTransportTCP
+	case udp.ProtocolNumber:
+		transport = semconv.NetTransportUDP
+	}
+
+	return t.tracer.Start(t.traceCtx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			transport,
+			semconv.NetPeerIPKey.String(net.IP(id.LocalAddress).String()),
+			semconv.NetPeerPortKey.Int(int(id.LocalPort)),
+			semconv.NetHostIPKey.String(net.IP(id.RemoteAddress).String()),
+			semconv.NetHostPortKey.Int(int(id.RemotePort)),
+		),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// endFlowSpan records the final counters of f on the span, err is recorded as the reason the flow failed
+func endFlowSpan(span trace.Span, f *flow, err error) {
+	span.SetAttributes(
+		egressBytesKey.Int64(int64(atomic.LoadUint64(&f.egressBytes))),
+		ingressBytesKey.Int64(int64(atomic.LoadUint64(&f.ingressBytes))),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// dialSpan wraps dial in a child span of ctx, so the time spent dialing shows up separately
+func (t *TunDevice) dialSpan(ctx context.Context, network, addr string, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	_, span := t.tracer.Start(ctx, "dial", trace.WithAttributes(
+		attribute.String("net.dial.network", network),
+		attribute.String("net.dial.address", addr),
+	))
+	defer span.End()
+
+	conn, err := dial(network, addr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return conn, err
+}
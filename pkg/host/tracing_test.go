@@ -0,0 +1,165 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingTcp(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	parentCtx, parent := provider.Tracer("test").Start(context.Background(), "build step")
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.Tracing.Context = parentCtx
+	opts.Tracing.TracerProvider = provider
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+	listener, port := hostListener(t)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	conn.Close()
+
+	require.Eventually(t, func() bool {
+		for _, span := range recorder.Ended() {
+			if span.Name() == "tcp.forward" {
+				return true
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*10)
+
+	var forward, dial sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "tcp.forward":
+			forward = span
+		case "dial":
+			dial = span
+		}
+	}
+	require.NotNil(t, dial)
+
+	assert.Equal(t, parent.SpanContext().TraceID(), forward.SpanContext().TraceID())
+	assert.Equal(t, parent.SpanContext().SpanID(), forward.Parent().SpanID())
+	assert.Equal(t, forward.SpanContext().SpanID(), dial.Parent().SpanID())
+
+	attrs := map[string]interface{}{}
+	for _, attr := range forward.Attributes() {
+		attrs[string(attr.Key)] = attr.Value.AsInterface()
+	}
+	assert.Equal(t, "127.0.0.1", attrs[string(rewriteKey)])
+	assert.Equal(t, int64(2), attrs[string(egressBytesKey)])
+	assert.Equal(t, int64(5), attrs[string(ingressBytesKey)])
+}
+
+func TestTracingDialFailure(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.Tracing.TracerProvider = provider
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	// grab a free port and close it again, so nothing is listening on it
+	listener, port := hostListener(t)
+	listener.Close()
+
+	conn, err := container.DialTCP(t, net.JoinHostPort("10.0.0.100", port))
+	if err == nil {
+		conn.Close()
+	}
+
+	require.Eventually(t, func() bool {
+		return len(recorder.Ended()) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, codes.Error, span.Status().Code, span.Name())
+	}
+}
+
+func TestTracingDenied(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	opts := DefaultOptions()
+	opts.TCPOptions.AllowHostConnections = true
+	opts.Tracing.TracerProvider = provider
+	opts.HostAliases = []HostAlias{
+		{Virtual: net.IPv4(10, 0, 0, 101), Host: net.IPv4(127, 0, 0, 1), Ports: []uint16{1}},
+	}
+	opts.Network.Segments = map[string]string{"app": "frontend", "db": "backend"}
+	network, err := NewNetwork(opts)
+	require.NoError(t, err)
+	defer network.Close()
+
+	app, err := network.NewAttachment("app", net.IPv4(10, 0, 0, 2))
+	require.NoError(t, err)
+	container := newAttachedTestContainer(t, app)
+	db, err := network.NewAttachment("db", net.IPv4(10, 0, 0, 3))
+	require.NoError(t, err)
+	echoContainerListener(t, newAttachedTestContainer(t, db), 80)
+
+	unreachable(t, container, "10.0.0.3:80")
+	unreachable(t, container, "10.0.0.101:22")
+
+	denied := func() map[string]sdktrace.ReadOnlySpan {
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			attrs := map[string]interface{}{}
+			for _, attr := range span.Attributes() {
+				attrs[string(attr.Key)] = attr.Value.AsInterface()
+			}
+			if attrs[string(policyKey)] == "deny" {
+				spans[attrs[string(policyReasonKey)].(string)] = span
+			}
+		}
+		return spans
+	}
+	require.Eventually(t, func() bool {
+		return len(denied()) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	for reason, span := range denied() {
+		assert.Equal(t, "tcp.forward", span.Name(), reason)
+		assert.Equal(t, codes.Error, span.Status().Code, reason)
+	}
+	assert.Contains(t, denied(), "segment policy")
+	assert.Contains(t, denied(), "host alias port")
+}
@@ -1,14 +1,18 @@
 package host
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/schoentoon/nsnet/pkg/common"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/buffer"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
@@ -20,8 +24,10 @@ var udpTimeout = time.Second * 60
 type UDPOptions struct {
 	Threads   int
 	QueueSize int
-	Stats     bool
-	Dialer    func(network, addr string) (net.Conn, error)
+	// Stats makes UDPStats() return the live counters, TunDevice.Snapshot() works regardless
+	Stats bool
+	// Dialer dials the flows of the direct egress, see EgressOptions
+	Dialer func(network, addr string) (net.Conn, error)
 }
 
 type udpHandler struct {
@@ -30,20 +36,30 @@ type udpHandler struct {
 	tun    *TunDevice
 	dialer func(network, addr string) (net.Conn, error)
 
-	stats *UDPStats
+	// closing stops new flows from being created, closed means the queue is closed.
+	// mutex guards the queue against being closed while we're sending on it
+	mutex   sync.RWMutex
+	closing uint32
+	closed  bool
+	workers sync.WaitGroup
+	wg      sync.WaitGroup
+
+	stats       *UDPStats
+	exposeStats bool
 }
 
 type UDPStats struct {
-	SentPacket uint32
-	RecvPacket uint32
+	SentPacket uint32 `json:"sent_packet"`
+	RecvPacket uint32 `json:"recv_packet"`
 
-	SentBytes uint64
-	RecvBytes uint64
+	SentBytes uint64 `json:"sent_bytes"`
+	RecvBytes uint64 `json:"recv_bytes"`
 }
 
 type udpPacket struct {
 	data buffer.VectorisedView
 	id   *stack.TransportEndpointID
+	nic  tcpip.NICID
 }
 
 func (p *udpPacket) Data() []byte {
@@ -75,36 +91,55 @@ func newUdpForwarder(t *TunDevice, opts UDPOptions) (*udpHandler, error) {
 		queue:  make(chan udpPacket, opts.QueueSize),
 		tun:    t,
 		dialer: opts.Dialer,
-	}
-	if out.dialer == nil {
-		out.dialer = net.Dial
-	}
+		stats:  new(UDPStats),
 
-	if opts.Stats {
-		out.stats = new(UDPStats)
+		exposeStats: opts.Stats,
 	}
 
 	udpHandler := func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
 		hdr := header.UDP(pkt.TransportHeader().View())
 		if int(hdr.Length()) > pkt.Data().Size()+header.UDPMinimumSize {
+			atomic.AddUint64(&t.drops.Malformed, 1)
 			return true
 		}
 
-		if out.stats != nil {
-			atomic.AddUint32(&out.stats.SentPacket, 1)
-			atomic.AddUint64(&out.stats.SentBytes, uint64(pkt.Size()))
+		// ports of the host that aren't allowed get a port unreachable, as if they're closed
+		if _, ok := t.hostAliases.rewrite(id.LocalAddress, id.LocalPort); !ok {
+			atomic.AddUint64(&t.drops.Policy, 1)
+			t.traceDenied(udp.ProtocolNumber, id, "host alias port")
+			return false
 		}
 
+		atomic.AddUint32(&out.stats.SentPacket, 1)
+		atomic.AddUint64(&out.stats.SentBytes, uint64(pkt.Size()))
+
 		// TODO: Check checksum?
 
 		packet := udpPacket{
 			data: pkt.Data().ExtractVV(),
 			id:   &id,
+			nic:  pkt.NICID,
+		}
+
+		// the queries for our own names are answered straight away, the rest is forwarded upstream like any other flow
+		if dns := t.dnsServer(); dns != nil && dns.intercepts(id) && dns.handle(id, pkt.NICID, packet.Data()) {
+			return true
+		}
+		if c := t.virtualPacketConn(id); c != nil {
+			c.deliver(packet)
+			return true
+		}
+
+		out.mutex.RLock()
+		defer out.mutex.RUnlock()
+		if out.closed {
+			return true
 		}
 
 		select {
 		case out.queue <- packet:
 		default:
+			atomic.AddUint64(&t.drops.UDPQueueFull, 1)
 			logrus.Warn("UDP Queue full, dropping packet")
 		}
 
@@ -113,6 +148,7 @@ func newUdpForwarder(t *TunDevice, opts UDPOptions) (*udpHandler, error) {
 
 	t.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpHandler)
 
+	out.workers.Add(opts.Threads)
 	for i := 0; i < opts.Threads; i++ {
 		go out.loop()
 	}
@@ -120,12 +156,37 @@ func newUdpForwarder(t *TunDevice, opts UDPOptions) (*udpHandler, error) {
 	return out, nil
 }
 
+// stopAccepting makes sure no new flows are created, packets of existing flows are still forwarded
+func (h *udpHandler) stopAccepting() {
+	atomic.StoreUint32(&h.closing, 1)
+}
+
+// Close stops the workers and closes whatever flows are left
 func (h *udpHandler) Close() error {
-	close(h.queue)
+	h.stopAccepting()
+
+	h.mutex.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mutex.Unlock()
+
+	// once the workers are gone no new flows can show up
+	h.workers.Wait()
+	h.pool.Range(func(_, val interface{}) bool {
+		_ = val.(*udpConn).Close()
+		return true
+	})
+
+	h.wg.Wait()
 	return nil
 }
 
 func (h *udpHandler) Stats() *UDPStats {
+	if !h.exposeStats {
+		return nil
+	}
 	return h.stats
 }
 
@@ -133,33 +194,85 @@ func (t *TunDevice) UDPStats() *UDPStats {
 	return t.udpHandler.Stats()
 }
 
+var (
+	errShuttingDown = errors.New("shutting down")
+	errNoUpstream   = errors.New("no upstream DNS server to forward to")
+)
+
 func (h *udpHandler) loop() {
+	defer h.workers.Done()
+
 	for packet := range h.queue {
 		err := h.handlePacket(packet)
-		if err != nil {
+		if err != nil && err != errShuttingDown {
 			logrus.Error(err)
 		}
 	}
 }
 
-func (h *udpHandler) getOrCreateConn(packet udpPacket) (out *net.UDPConn, err error) {
+// udpConn is what we keep in the pool for every UDP association
+type udpConn struct {
+	net.Conn
+	flow *flow
+	span trace.Span
+}
+
+func (h *udpHandler) getOrCreateConn(packet udpPacket) (out *udpConn, err error) {
 	key := packet.Key()
 	val, ok := h.pool.Load(key)
 	if !ok {
-		addr := packet.LocalAddr()
-		conn, err := net.Dial("udp", addr.String())
+		if atomic.LoadUint32(&h.closing) == 1 {
+			return nil, errShuttingDown
+		}
+
+		f := newFlow(udp.ProtocolNumber, *packet.ID())
+		ctx, span := h.tun.startFlowSpan("udp.forward", f)
+
+		addr, rewrite := h.tun.upstream("udp", packet.ID().LocalAddress, packet.ID().LocalPort)
+		if rewrite != "" {
+			span.SetAttributes(rewriteKey.String(rewrite))
+		}
+		if dns := h.tun.dnsServer(); dns != nil && dns.intercepts(*packet.ID()) {
+			if dns.upstream == "" {
+				endFlowSpan(span, f, errNoUpstream)
+				return nil, errNoUpstream
+			}
+			addr = dns.upstream
+			span.SetAttributes(rewriteKey.String(addr))
+		}
+
+		conn, err := h.tun.dialEgress(ctx, f, "udp", addr)
 		if err != nil {
+			atomic.AddUint64(&h.tun.drops.DialFailed, 1)
+			endFlowSpan(span, f, err)
 			return nil, err
 		}
-		val, stored := h.pool.LoadOrStore(key, conn)
+		out = &udpConn{
+			Conn: conn,
+			flow: f,
+			span: span,
+		}
+		f.closer = conn.Close
+		val, stored := h.pool.LoadOrStore(key, out)
 		if stored { // if this is true it was stored elsewhere in the meantime, so we close ours
 			_ = conn.Close()
+			span.SetAttributes(endReasonKey.String("duplicate"))
+			span.End()
 		} else {
-			go h.udpForwarder(val.(*net.UDPConn), packet.ID(), packet.Key())
+			h.tun.flows.add(out.flow)
+			h.wg.Add(1)
+			go h.udpForwarder(out, packet.ID(), packet.nic, packet.Key())
 		}
-		return val.(*net.UDPConn), nil
+		return val.(*udpConn), nil
 	}
-	return val.(*net.UDPConn), nil
+	return val.(*udpConn), nil
+}
+
+func (t *TunDevice) dnsServer() *dnsServer {
+	if t.network == nil {
+		return nil
+	}
+	return t.network.dns
 }
 
 func (h *udpHandler) removeConn(key string) {
@@ -172,20 +285,36 @@ func (h *udpHandler) handlePacket(packet udpPacket) error {
 		return err
 	}
 
-	_, err = conn.Write(packet.Data())
+	// the workers are shared by all the flows, so they can't wait for the rate limit
+	data := packet.Data()
+	if !h.tun.rateLimiter.allow(len(data)) {
+		atomic.AddUint64(&h.tun.drops.RateLimited, 1)
+		return nil
+	}
+
+	n, err := conn.Write(data)
+	if err == nil {
+		conn.flow.addEgress(n)
+	}
 
 	return err
 }
 
-func (h *udpHandler) udpForwarder(conn *net.UDPConn, id *stack.TransportEndpointID, key string) {
+func (h *udpHandler) udpForwarder(conn *udpConn, id *stack.TransportEndpointID, nic tcpip.NICID, key string) {
+	defer h.wg.Done()
+
+	var err error
+	defer func() {
+		endFlowSpan(conn.span, conn.flow, err)
+	}()
 	defer conn.Close()
+	defer h.tun.flows.remove(conn.flow)
 	defer h.removeConn(key)
 
 	buf := make([]byte, common.MTU)
-	r, tcpipErr := h.tun.stack.FindRoute(nicID,
-		id.LocalAddress, id.RemoteAddress,
-		header.IPv4ProtocolNumber, false)
+	r, tcpipErr := h.tun.findUDPRoute(nic, id)
 	if tcpipErr != nil {
+		err = errors.New(tcpipErr.String())
 		return
 	}
 	defer r.Release()
@@ -193,52 +322,83 @@ func (h *udpHandler) udpForwarder(conn *net.UDPConn, id *stack.TransportEndpoint
 	for {
 		_ = conn.SetReadDeadline(time.Now().Add(udpTimeout))
 
-		n, err := conn.Read(buf)
-		if err != nil {
+		var n int
+		n, err = conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			conn.span.SetAttributes(endReasonKey.String("idle timeout"))
+			err = nil
+			return
+		} else if err != nil {
 			return
 		}
-
-		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			ReserveHeaderBytes: header.UDPMinimumSize + int(r.MaxHeaderLength()),
-			Data:               buffer.NewVectorisedView(n, []buffer.View{buffer.NewViewFromBytes(buf[:n])}),
-		})
-
-		udpHdr := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
-		pkt.TransportProtocolNumber = udp.ProtocolNumber
-
-		length := uint16(pkt.Size())
-		udpHdr.Encode(&header.UDPFields{
-			SrcPort: id.LocalPort,
-			DstPort: id.RemotePort,
-			Length:  length,
-		})
-
-		// Set the checksum field unless TX checksum offload is enabled.
-		// On IPv4, UDP checksum is optional, and a zero value indicates the
-		// transmitter skipped the checksum generation (RFC768).
-		// On IPv6, UDP checksum is not optional (RFC2460 Section 8.1).
-		if r.RequiresTXTransportChecksum() &&
-			(r.NetProto() == header.IPv6ProtocolNumber) {
-			xsum := r.PseudoHeaderChecksum(udp.ProtocolNumber, length)
-			for _, v := range pkt.Data().Views() {
-				xsum = header.Checksum(v, xsum)
-			}
-			udpHdr.SetChecksum(^udpHdr.CalculateChecksum(xsum))
+		if err = h.tun.rateLimiter.wait(conn.flow.ctx, n); err != nil {
+			return
 		}
 
-		ttl := r.DefaultTTL()
-
-		if tcpipErr := r.WritePacket(stack.NetworkHeaderParams{
-			Protocol: udp.ProtocolNumber,
-			TTL:      ttl,
-			TOS:      0, /* default */
-		}, pkt); tcpipErr != nil {
+		size, tcpipErr := writeUDP(r, id, buf[:n])
+		if tcpipErr != nil {
+			err = errors.New(tcpipErr.String())
 			return
 		}
 
-		if h.stats != nil {
-			atomic.AddUint32(&h.stats.RecvPacket, 1)
-			atomic.AddUint64(&h.stats.RecvBytes, uint64(pkt.Size()))
+		conn.flow.addIngress(n)
+		atomic.AddUint32(&h.stats.RecvPacket, 1)
+		atomic.AddUint64(&h.stats.RecvBytes, uint64(size))
+	}
+}
+
+// findUDPRoute finds the route back to the container that sent a packet with id on nic
+func (t *TunDevice) findUDPRoute(nic tcpip.NICID, id *stack.TransportEndpointID) (*stack.Route, tcpip.Error) {
+	netProto := header.IPv4ProtocolNumber
+	if len(id.RemoteAddress) == header.IPv6AddressSize {
+		netProto = header.IPv6ProtocolNumber
+	}
+
+	return t.stack.FindRoute(nic,
+		id.LocalAddress, id.RemoteAddress,
+		netProto, false)
+}
+
+// writeUDP sends data to the container as a reply to id, it returns the size of the packet including the UDP header
+func writeUDP(r *stack.Route, id *stack.TransportEndpointID, data []byte) (int, tcpip.Error) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: header.UDPMinimumSize + int(r.MaxHeaderLength()),
+		Data:               buffer.NewVectorisedView(len(data), []buffer.View{buffer.NewViewFromBytes(data)}),
+	})
+	defer pkt.DecRef()
+
+	udpHdr := header.UDP(pkt.TransportHeader().Push(header.UDPMinimumSize))
+	pkt.TransportProtocolNumber = udp.ProtocolNumber
+
+	length := uint16(pkt.Size())
+	udpHdr.Encode(&header.UDPFields{
+		SrcPort: id.LocalPort,
+		DstPort: id.RemotePort,
+		Length:  length,
+	})
+
+	// Set the checksum field unless TX checksum offload is enabled.
+	// On IPv4, UDP checksum is optional, and a zero value indicates the
+	// transmitter skipped the checksum generation (RFC768).
+	// On IPv6, UDP checksum is not optional (RFC2460 Section 8.1).
+	if r.RequiresTXTransportChecksum() &&
+		(r.NetProto() == header.IPv6ProtocolNumber) {
+		xsum := r.PseudoHeaderChecksum(udp.ProtocolNumber, length)
+		for _, v := range pkt.Data().Views() {
+			xsum = header.Checksum(v, xsum)
 		}
+		udpHdr.SetChecksum(^udpHdr.CalculateChecksum(xsum))
 	}
+
+	ttl := r.DefaultTTL()
+
+	if tcpipErr := r.WritePacket(stack.NetworkHeaderParams{
+		Protocol: udp.ProtocolNumber,
+		TTL:      ttl,
+		TOS:      0, /* default */
+	}, pkt); tcpipErr != nil {
+		return 0, tcpipErr
+	}
+
+	return int(length), nil
 }
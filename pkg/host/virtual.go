@@ -0,0 +1,397 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// the connections that are waiting to be accepted, any more than this are reset
+const virtualBacklog = 128
+
+var errVirtualAddrInUse = errors.New("virtual address already in use")
+
+type virtualKey struct {
+	network string
+	addr    tcpip.Address
+	port    uint16
+}
+
+// virtualServices are the listeners created using Listen, by their virtual address
+type virtualServices struct {
+	mutex     sync.RWMutex
+	listeners map[virtualKey]*virtualListener
+	conns     map[virtualKey]*virtualPacketConn
+}
+
+// Listen returns a listener for the connections from the container to virtualAddr, without using a host port.
+// Network is tcp, tcp4 or tcp6 and virtualAddr is an ip:port, it can be any address the container doesn't
+// reach otherwise. See ListenPacket for udp.
+func (t *TunDevice) Listen(network, virtualAddr string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	addr, key, err := parseVirtualAddr("tcp", virtualAddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	t.virtual.mutex.Lock()
+	defer t.virtual.mutex.Unlock()
+
+	// checked while holding the lock, so Shutdown is guaranteed to close it
+	if err := t.Err(); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	if _, ok := t.virtual.listeners[key]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errVirtualAddrInUse}
+	}
+	if err := t.claimVirtual(key.addr); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l := &virtualListener{
+		tun:   t,
+		key:   key,
+		addr:  &net.TCPAddr{IP: addr.IP, Port: addr.Port},
+		conns: make(chan net.Conn, virtualBacklog),
+		done:  make(chan struct{}),
+	}
+	t.virtual.listeners[key] = l
+	return l, nil
+}
+
+// ListenPacket is Listen for udp, udp4 or udp6
+func (t *TunDevice) ListenPacket(network, virtualAddr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	addr, key, err := parseVirtualAddr("udp", virtualAddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	t.virtual.mutex.Lock()
+	defer t.virtual.mutex.Unlock()
+
+	// checked while holding the lock, so Shutdown is guaranteed to close it
+	if err := t.Err(); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	if _, ok := t.virtual.conns[key]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errVirtualAddrInUse}
+	}
+	if err := t.claimVirtual(key.addr); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	c := &virtualPacketConn{
+		tun:     t,
+		key:     key,
+		addr:    addr,
+		packets: make(chan udpPacket, virtualBacklog),
+		done:    make(chan struct{}),
+		reading: newDeadline(),
+	}
+	t.virtual.conns[key] = c
+	return c, nil
+}
+
+func parseVirtualAddr(network, virtualAddr string) (*net.UDPAddr, virtualKey, error) {
+	host, port, err := net.SplitHostPort(virtualAddr)
+	if err != nil {
+		return nil, virtualKey{}, err
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil || p == 0 {
+		return nil, virtualKey{}, fmt.Errorf("invalid virtual address %s", virtualAddr)
+	}
+
+	key := virtualKey{network: network, addr: ipAddress(ip), port: uint16(p)}
+	return &net.UDPAddr{IP: ip, Port: int(p)}, key, nil
+}
+
+func (t *TunDevice) virtualListener(id stack.TransportEndpointID) *virtualListener {
+	t.virtual.mutex.RLock()
+	defer t.virtual.mutex.RUnlock()
+	return t.virtual.listeners[virtualKey{network: "tcp", addr: id.LocalAddress, port: id.LocalPort}]
+}
+
+func (t *TunDevice) virtualPacketConn(id stack.TransportEndpointID) *virtualPacketConn {
+	t.virtual.mutex.RLock()
+	defer t.virtual.mutex.RUnlock()
+	return t.virtual.conns[virtualKey{network: "udp", addr: id.LocalAddress, port: id.LocalPort}]
+}
+
+// closeVirtual closes all the listeners, as part of Shutdown
+func (t *TunDevice) closeVirtual() {
+	t.virtual.mutex.RLock()
+	listeners := make([]*virtualListener, 0, len(t.virtual.listeners))
+	for _, l := range t.virtual.listeners {
+		listeners = append(listeners, l)
+	}
+	conns := make([]*virtualPacketConn, 0, len(t.virtual.conns))
+	for _, c := range t.virtual.conns {
+		conns = append(conns, c)
+	}
+	t.virtual.mutex.RUnlock()
+
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// nicFor returns the NIC the container with addr is behind
+func (t *TunDevice) nicFor(addr tcpip.Address) tcpip.NICID {
+	if t.network != nil {
+		if a := t.network.lookup(addr); a != nil {
+			return a.nic
+		}
+		return 0
+	}
+	return nicID
+}
+
+type virtualListener struct {
+	tun  *TunDevice
+	key  virtualKey
+	addr net.Addr
+
+	conns chan net.Conn
+	done  chan struct{}
+
+	// mutex makes sure no connection is delivered after Close, as nobody would close it
+	mutex  sync.Mutex
+	closed bool
+}
+
+// deliver hands conn to Accept, it returns false if the listener is closed or its backlog is full
+func (l *virtualListener) deliver(conn net.Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+
+	select {
+	case l.conns <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *virtualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+func (l *virtualListener) Close() error {
+	l.tun.virtual.mutex.Lock()
+	if l.tun.virtual.listeners[l.key] == l {
+		delete(l.tun.virtual.listeners, l.key)
+		l.tun.releaseVirtual(l.key.addr)
+	}
+	l.tun.virtual.mutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+
+	for {
+		select {
+		case conn := <-l.conns:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *virtualListener) Addr() net.Addr {
+	return l.addr
+}
+
+type virtualPacketConn struct {
+	tun  *TunDevice
+	key  virtualKey
+	addr *net.UDPAddr
+
+	packets   chan udpPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	reading deadline
+}
+
+// deadline is a deadline that can be changed while somebody is waiting on it, just like the ones of net.Pipe
+type deadline struct {
+	mutex sync.Mutex
+	timer *time.Timer
+	// passed is closed once the deadline passed, it is replaced when the deadline is moved after that
+	passed chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{passed: make(chan struct{})}
+}
+
+// set moves the deadline to t, a zero t means there is no deadline
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// when the timer already fired we wait for it to close passed, so we don't replace it before it did
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.passed
+	}
+	d.timer = nil
+
+	closed := isClosed(d.passed)
+	if t.IsZero() {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		return
+	}
+
+	if until := time.Until(t); until > 0 {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		passed := d.passed
+		d.timer = time.AfterFunc(until, func() {
+			close(passed)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.passed)
+	}
+}
+
+// wait returns a channel that is closed once the deadline passed
+func (d *deadline) wait() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.passed
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues packet for ReadFrom, the packet is dropped when nobody keeps up with reading
+func (c *virtualPacketConn) deliver(packet udpPacket) {
+	select {
+	case <-c.done:
+	case c.packets <- packet:
+	default:
+		atomic.AddUint64(&c.tun.drops.UDPQueueFull, 1)
+	}
+}
+
+func (c *virtualPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		n := copy(b, packet.Data())
+		return n, packet.RemoteAddr(), nil
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	case <-c.reading.wait():
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (c *virtualPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.addr, Err: fmt.Errorf("invalid address %s", addr)}
+	}
+
+	id := &stack.TransportEndpointID{
+		LocalAddress:  c.key.addr,
+		LocalPort:     c.key.port,
+		RemoteAddress: ipAddress(to.IP),
+		RemotePort:    uint16(to.Port),
+	}
+	r, tcpipErr := c.tun.findUDPRoute(c.tun.nicFor(id.RemoteAddress), id)
+	if tcpipErr != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.addr, Err: errors.New(tcpipErr.String())}
+	}
+	defer r.Release()
+
+	if _, tcpipErr := writeUDP(r, id, b); tcpipErr != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.addr, Err: errors.New(tcpipErr.String())}
+	}
+	return len(b), nil
+}
+
+func (c *virtualPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.tun.virtual.mutex.Lock()
+		if c.tun.virtual.conns[c.key] == c {
+			delete(c.tun.virtual.conns, c.key)
+			c.tun.releaseVirtual(c.key.addr)
+		}
+		c.tun.virtual.mutex.Unlock()
+
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *virtualPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *virtualPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline also applies to a ReadFrom that is already waiting
+func (c *virtualPacketConn) SetReadDeadline(t time.Time) error {
+	c.reading.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block
+func (c *virtualPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	listener, err := tun.Listen("tcp", "10.0.0.200:80")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.200:80", listener.Addr().String())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	_, err = tun.Listen("tcp", "10.0.0.200:80")
+	assert.ErrorIs(t, err, errVirtualAddrInUse)
+
+	conn, err := container.DialTCP(t, "10.0.0.200:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello virtual service")
+
+	require.NoError(t, listener.Close())
+	_, err = listener.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+
+	// the address is free again once closed
+	again, err := tun.Listen("tcp", "10.0.0.200:80")
+	require.NoError(t, err)
+	require.NoError(t, again.Close())
+}
+
+func TestListenPacket(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	pc, err := tun.ListenPacket("udp", "10.0.0.200:53")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := container.DialUDP(t, "10.0.0.200:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello virtual udp")
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Millisecond*10)))
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(make([]byte, 10))
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestListenPacketDeadline(t *testing.T) {
+	tun, err := New(DefaultOptions())
+	require.NoError(t, err)
+	defer tun.Close()
+	container := newTestContainer(t, tun)
+
+	pc, err := tun.ListenPacket("udp", "10.0.0.200:53")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// a deadline set while ReadFrom is waiting stops it
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 10))
+		read <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	require.NoError(t, pc.SetReadDeadline(time.Now()))
+	select {
+	case err := <-read:
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(time.Second * 5):
+		t.Fatal("ReadFrom didn't notice the deadline")
+	}
+
+	// and clearing it again makes reading work as before
+	require.NoError(t, pc.SetReadDeadline(time.Time{}))
+	conn, err := container.DialUDP(t, "10.0.0.200:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 10)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestListenNetwork(t *testing.T) {
+	network, err := NewNetwork(DefaultOptions())
+	require.NoError(t, err)
+
+	app, err := network.NewAttachment("app", nil)
+	require.NoError(t, err)
+	container := newAttachedTestContainer(t, app)
+
+	pc, err := network.ListenPacket("udp", "10.0.1.1:9000")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, _ = pc.WriteTo(buf[:n], addr)
+	}()
+
+	conn, err := container.DialUDP(t, "10.0.1.1:9000")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "ping")
+
+	// the listeners are closed along with the network, and no new ones can be made
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, network.Shutdown(ctx))
+	_, _, err = pc.ReadFrom(make([]byte, 10))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = network.Listen("tcp", "10.0.1.1:80")
+	assert.Error(t, err)
+}
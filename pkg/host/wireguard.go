@@ -0,0 +1,370 @@
+package host
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// WireGuardOptions configures a userspace WireGuard interface, the keys are base64 encoded like wg(8) does
+type WireGuardOptions struct {
+	PrivateKey string
+	// Addresses are the addresses of our end of the tunnel
+	Addresses []net.IP
+	// ListenPort is the UDP port the tunnel is reachable on, a random port is used when it is 0
+	ListenPort uint16
+	// MTU defaults to 1420, which leaves room for the WireGuard headers on a regular 1500 MTU link
+	MTU   int
+	Peers []WireGuardPeer
+
+	// Bind sends and receives the encrypted packets, it uses UDP sockets on the host when nil
+	Bind conn.Bind
+	// Resolver looks up the names given to DialContext, it should reach a DNS server through the tunnel (see
+	// net.Resolver.Dial) so private names don't leak to the resolver of the host. Names are refused when nil.
+	Resolver *net.Resolver
+}
+
+type WireGuardPeer struct {
+	PublicKey    string
+	PresharedKey string
+	// Endpoint is the host:port of the peer, it may be left empty for peers that connect to us
+	Endpoint   string
+	AllowedIPs []*net.IPNet
+	// PersistentKeepalive keeps the tunnel open through NATs, it is disabled when 0
+	PersistentKeepalive time.Duration
+}
+
+const (
+	defaultWireGuardMTU = 1420
+	// how many packets of our netstack can wait for WireGuard to pick them up
+	wireGuardQueueSize = 1024
+)
+
+// WireGuard is a userspace WireGuard interface with a netstack of its own, so the traffic can leave through
+// the tunnel without root and without touching the routes of the host. Use DialContext as an EgressDialer.
+type WireGuard struct {
+	device   *device.Device
+	tun      *wireGuardTun
+	resolver *net.Resolver
+
+	// the address families our end of the tunnel has an address of
+	ipv4, ipv6 bool
+}
+
+// NewWireGuard brings up the interface, Close tears it down again
+func NewWireGuard(opts WireGuardOptions) (*WireGuard, error) {
+	config, err := opts.uapi()
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Addresses) == 0 {
+		return nil, errors.New("the WireGuard interface needs at least one address")
+	}
+	if opts.MTU == 0 {
+		opts.MTU = defaultWireGuardMTU
+	}
+	if opts.Bind == nil {
+		opts.Bind = conn.NewDefaultBind()
+	}
+
+	t, err := newWireGuardTun(opts.Addresses, opts.MTU)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &WireGuard{
+		device: device.NewDevice(t, opts.Bind, &device.Logger{
+			Verbosef: logrus.WithField("wireguard", true).Debugf,
+			Errorf:   logrus.WithField("wireguard", true).Errorf,
+		}),
+		tun:      t,
+		resolver: opts.Resolver,
+	}
+	for _, ip := range opts.Addresses {
+		if ip.To4() != nil {
+			out.ipv4 = true
+		} else {
+			out.ipv6 = true
+		}
+	}
+	if err := out.device.IpcSet(config); err != nil {
+		_ = out.Close()
+		return nil, err
+	}
+	if err := out.device.Up(); err != nil {
+		_ = out.Close()
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// uapi turns the options into the configuration protocol of WireGuard, which wants hex encoded keys
+func (opts *WireGuardOptions) uapi() (string, error) {
+	var b strings.Builder
+
+	key, err := wireGuardKey(opts.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	fmt.Fprintf(&b, "private_key=%s\n", key)
+	if opts.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", opts.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	for _, peer := range opts.Peers {
+		key, err := wireGuardKey(peer.PublicKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid public key of peer: %w", err)
+		}
+		fmt.Fprintf(&b, "public_key=%s\n", key)
+
+		if peer.PresharedKey != "" {
+			key, err := wireGuardKey(peer.PresharedKey)
+			if err != nil {
+				return "", fmt.Errorf("invalid preshared key of peer %s: %w", peer.PublicKey, err)
+			}
+			fmt.Fprintf(&b, "preshared_key=%s\n", key)
+		}
+		if peer.Endpoint != "" {
+			endpoint, err := net.ResolveUDPAddr("udp", peer.Endpoint)
+			if err != nil {
+				return "", fmt.Errorf("invalid endpoint of peer %s: %w", peer.PublicKey, err)
+			}
+			fmt.Fprintf(&b, "endpoint=%s\n", endpoint)
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(peer.PersistentKeepalive.Seconds()))
+		}
+		for _, allowed := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", allowed)
+		}
+	}
+
+	return b.String(), nil
+}
+
+func wireGuardKey(key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) != 32 {
+		return "", fmt.Errorf("keys are 32 bytes, not %d", len(raw))
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// DialContext dials addr from our end of the tunnel, hostnames are looked up using WireGuardOptions.Resolver.
+// The addresses are tried in turn, skipping those of a family network or our end of the tunnel doesn't have.
+func (w *WireGuard) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := net.DefaultResolver.LookupPort(ctx, network, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if w.resolver == nil {
+		return nil, fmt.Errorf("can't resolve %s without a resolver that goes through the tunnel", host)
+	} else if ips, err = w.resolver.LookupIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+
+	var errs error
+	for _, ip := range ips {
+		target := tcpip.FullAddress{NIC: nicID, Addr: ipAddress(ip), Port: uint16(p)}
+		proto := header.IPv4ProtocolNumber
+		if len(target.Addr) == header.IPv6AddressSize {
+			proto = header.IPv6ProtocolNumber
+		}
+		if !w.reachable(network, proto) {
+			continue
+		}
+
+		var conn net.Conn
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			conn, err = gonet.DialContextTCP(ctx, w.tun.stack, target, proto)
+		case "udp", "udp4", "udp6":
+			conn, err = gonet.DialUDP(w.tun.stack, nil, &target, proto)
+		default:
+			return nil, net.UnknownNetworkError(network)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		errs = multierr.Append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if errs == nil {
+		return nil, fmt.Errorf("none of the addresses of %s can be reached over %s from the tunnel", host, network)
+	}
+	return nil, errs
+}
+
+// reachable returns whether addresses of proto can be dialed over network from our end of the tunnel
+func (w *WireGuard) reachable(network string, proto tcpip.NetworkProtocolNumber) bool {
+	if proto == header.IPv6ProtocolNumber {
+		return w.ipv6 && !strings.HasSuffix(network, "4")
+	}
+	return w.ipv4 && !strings.HasSuffix(network, "6")
+}
+
+// Close tears down the tunnel, the connections that were dialed through it are reset
+func (w *WireGuard) Close() error {
+	w.device.Close()
+	w.tun.stack.Close()
+	w.tun.stack.Wait()
+	return nil
+}
+
+// wireGuardTun is the tun.Device of WireGuard, the packets are handed to and from a netstack instead of the kernel
+type wireGuardTun struct {
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	mtu      int
+	events   chan tun.Event
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWireGuardTun(addresses []net.IP, mtu int) (*wireGuardTun, error) {
+	out := &wireGuardTun{
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		}),
+		endpoint: channel.New(wireGuardQueueSize, uint32(mtu), ""),
+		mtu:      mtu,
+		events:   make(chan tun.Event, 1),
+	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+
+	if tcpipErr := out.stack.CreateNIC(nicID, out.endpoint); tcpipErr != nil {
+		out.stack.Close()
+		return nil, errors.New(tcpipErr.String())
+	}
+	for _, ip := range addresses {
+		addr := ipAddress(ip)
+		proto := header.IPv4ProtocolNumber
+		if len(addr) == header.IPv6AddressSize {
+			proto = header.IPv6ProtocolNumber
+		}
+		tcpipErr := out.stack.AddProtocolAddress(nicID, tcpip.ProtocolAddress{
+			Protocol:          proto,
+			AddressWithPrefix: addr.WithPrefix(),
+		}, stack.AddressProperties{})
+		if tcpipErr != nil {
+			out.stack.Close()
+			return nil, errors.New(tcpipErr.String())
+		}
+	}
+	// WireGuard itself decides which peer a packet goes to, so everything is routed into the tunnel
+	out.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+
+	out.events <- tun.EventUp
+	return out, nil
+}
+
+func (t *wireGuardTun) File() *os.File {
+	return nil
+}
+
+// Read hands the packets our netstack sends to WireGuard, which encrypts them
+func (t *wireGuardTun) Read(buf []byte, offset int) (int, error) {
+	pkt := t.endpoint.ReadContext(t.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	defer pkt.DecRef()
+
+	n := 0
+	for _, v := range pkt.Views() {
+		n += copy(buf[offset+n:], v)
+	}
+	return n, nil
+}
+
+// Write hands the packets WireGuard decrypted to our netstack
+func (t *wireGuardTun) Write(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewVectorisedView(len(packet), []buffer.View{buffer.NewViewFromBytes(packet)}),
+	})
+	defer pkb.DecRef()
+
+	switch version := header.IPVersion(packet); version {
+	case header.IPv4Version:
+		t.endpoint.InjectInbound(header.IPv4ProtocolNumber, pkb)
+	case header.IPv6Version:
+		t.endpoint.InjectInbound(header.IPv6ProtocolNumber, pkb)
+	default:
+		// WireGuard logs this, it shouldn't happen as it checks the allowed IPs of the packet itself
+		return 0, fmt.Errorf("unknown IP version %d", version)
+	}
+	return len(packet), nil
+}
+
+func (t *wireGuardTun) Flush() error {
+	return nil
+}
+
+func (t *wireGuardTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *wireGuardTun) Name() (string, error) {
+	return "nsnet-wg", nil
+}
+
+func (t *wireGuardTun) Events() chan tun.Event {
+	return t.events
+}
+
+// Close is called by the WireGuard device as it closes
+func (t *wireGuardTun) Close() error {
+	t.cancel()
+	t.endpoint.Close()
+	close(t.events)
+	return nil
+}
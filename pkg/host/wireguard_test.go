@@ -0,0 +1,200 @@
+package host
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func wireGuardKeyPair(t *testing.T) (private, public string) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	// clamped as described in https://cr.yp.to/ecdh.html
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	pub, err := curve25519.X25519(key[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key[:]), base64.StdEncoding.EncodeToString(pub)
+}
+
+// wireGuardPeers connects two WireGuard interfaces in process, the client is 192.168.77.1 and the server 192.168.77.2
+func wireGuardPeers(t *testing.T) (client, server *WireGuard) {
+	clientPrivate, clientPublic := wireGuardKeyPair(t)
+	serverPrivate, serverPublic := wireGuardKeyPair(t)
+	binds := bindtest.NewChannelBinds()
+
+	server, err := NewWireGuard(WireGuardOptions{
+		PrivateKey: serverPrivate,
+		Addresses:  []net.IP{net.IPv4(192, 168, 77, 2)},
+		Peers: []WireGuardPeer{{
+			PublicKey:  clientPublic,
+			AllowedIPs: []*net.IPNet{mustCIDR(t, "192.168.77.1/32")},
+		}},
+		Bind: binds[1],
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	client, err = NewWireGuard(WireGuardOptions{
+		PrivateKey: clientPrivate,
+		Addresses:  []net.IP{net.IPv4(192, 168, 77, 1)},
+		Peers: []WireGuardPeer{{
+			PublicKey:  serverPublic,
+			Endpoint:   "127.0.0.1:1",
+			AllowedIPs: []*net.IPNet{mustCIDR(t, "192.168.77.0/24")},
+		}},
+		Bind: binds[0],
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return client, server
+}
+
+// wireGuardEchoServer echoes the TCP connections to port 80 of the server
+func wireGuardEchoServer(t *testing.T, server *WireGuard) {
+	listener, err := gonet.ListenTCP(server.tun.stack, tcpip.FullAddress{NIC: nicID, Port: 80}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func TestWireGuardEgress(t *testing.T) {
+	client, server := wireGuardPeers(t)
+	wireGuardEchoServer(t, server)
+
+	packetConn, err := gonet.DialUDP(server.tun.stack, &tcpip.FullAddress{NIC: nicID, Port: 53}, nil, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	defer packetConn.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = packetConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	opts := DefaultOptions()
+	opts.Egress = EgressOptions{
+		Dialers: map[string]EgressDialer{"wg": client.DialContext},
+		Routes:  []EgressRoute{{CIDR: mustCIDR(t, "192.168.77.0/24"), Egress: "wg"}},
+	}
+	tun, err := New(opts)
+	require.NoError(t, err)
+	defer tun.Close()
+
+	container := newTestContainer(t, tun)
+
+	conn, err := container.DialTCP(t, "192.168.77.2:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello through the tunnel")
+
+	conn, err = container.DialUDP(t, "192.168.77.2:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello over udp")
+
+	stats := tun.Snapshot().Egress["wg"]
+	assert.EqualValues(t, 1, stats.TCPConns)
+	assert.EqualValues(t, 1, stats.UDPFlows)
+}
+
+func TestWireGuardDial(t *testing.T) {
+	client, server := wireGuardPeers(t)
+	wireGuardEchoServer(t, server)
+
+	// names aren't looked up on the host, and our end of the tunnel has no IPv6 address
+	_, err := client.DialContext(context.Background(), "tcp", "localhost:80")
+	assert.Error(t, err)
+	_, err = client.DialContext(context.Background(), "tcp", "[fd00::2]:80")
+	assert.Error(t, err)
+	_, err = client.DialContext(context.Background(), "tcp6", "192.168.77.2:80")
+	assert.Error(t, err)
+
+	// a resolver that knows the server by both of its addresses, only the IPv4 address is of use to us
+	client.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			ours, theirs := net.Pipe()
+			go func() {
+				defer theirs.Close()
+				for {
+					query, err := readDNSTCP(theirs)
+					if err != nil {
+						return
+					}
+					var msg dnsmessage.Message
+					if msg.Unpack(query) != nil || len(msg.Questions) == 0 {
+						return
+					}
+					msg.Response = true
+					q := msg.Questions[0]
+					hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+					switch q.Type {
+					case dnsmessage.TypeA:
+						msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 168, 77, 2}}}}
+					case dnsmessage.TypeAAAA:
+						msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0: 0xfd, 15: 2}}}}
+					}
+					response, err := msg.Pack()
+					if err != nil || writeDNSTCP(theirs, response) != nil {
+						return
+					}
+				}
+			}()
+			return ours, nil
+		},
+	}
+
+	conn, err := client.DialContext(context.Background(), "tcp", "server.corp.:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	echo(t, conn, "hello by name")
+
+	// packets that aren't IP are reported to WireGuard
+	_, err = client.tun.Write([]byte{0, 0, 0, 0, 0x10}, 4)
+	assert.Error(t, err)
+}
+
+func TestWireGuardOptions(t *testing.T) {
+	private, public := wireGuardKeyPair(t)
+
+	for _, opts := range []WireGuardOptions{
+		{PrivateKey: "nope", Addresses: []net.IP{net.IPv4(192, 168, 77, 1)}},
+		{PrivateKey: private},
+		{PrivateKey: private, Addresses: []net.IP{net.IPv4(192, 168, 77, 1)}, Peers: []WireGuardPeer{{PublicKey: "AAAA"}}},
+		{PrivateKey: private, Addresses: []net.IP{net.IPv4(192, 168, 77, 1)}, Peers: []WireGuardPeer{{PublicKey: public, Endpoint: "nope"}}},
+	} {
+		_, err := NewWireGuard(opts)
+		assert.Error(t, err)
+	}
+}